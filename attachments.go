@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// telegramFileLimit is maximum size of file which bot can upload with Bot API
+const telegramFileLimit = 50 << 20
+
+var unsafeFilenameRegexp = regexp.MustCompile(`[^\p{L}\p{N}._ -]+`)
+
+// EmailAttachment is attachment extracted from email for uploading to Telegram
+type EmailAttachment struct {
+	Name string
+	Data []byte
+}
+
+// ExtractAttachments reads MIME message and returns attachments which fit into Telegram file limit
+// and names of skipped attachments
+func ExtractAttachments(r io.Reader) ([]*EmailAttachment, []string, error) {
+	mr, err := mail.CreateReader(r)
+	if err != nil && !message.IsUnknownCharset(err) {
+		return nil, nil, err
+	}
+	attachments := make([]*EmailAttachment, 0)
+	skipped := make([]string, 0)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil && !message.IsUnknownCharset(err) {
+			return attachments, skipped, err
+		}
+		h, ok := part.Header.(*mail.AttachmentHeader)
+		if !ok {
+			continue
+		}
+		filename, _ := h.Filename()
+		if filename == "" {
+			filename = "unnamed"
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(part.Body, telegramFileLimit+1))
+		if err != nil {
+			skipped = append(skipped, fmt.Sprintf("%s (%v)", filename, err))
+			continue
+		}
+		if len(data) > telegramFileLimit {
+			skipped = append(skipped, filename+" (larger than 50 MB)")
+			continue
+		}
+		attachments = append(attachments, &EmailAttachment{Name: filename, Data: data})
+	}
+	return attachments, skipped, nil
+}
+
+// fetchRawEmail fetches whole email without marking it seen
+func fetchRawEmail(src MailSource, folder string, uid uint32) (*imap.Message, imap.Literal, error) {
+	messages, err := src.Fetch(folder, []uint32{uid}, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, bodySectionToPeek.FetchItem()})
+	if err != nil {
+		return nil, nil, err
+	}
+	var email *imap.Message
+	var body imap.Literal
+	for _, msg := range messages {
+		if literal := msg.GetBody(bodySectionToPeek); msg.Uid == uid && literal != nil {
+			email, body = msg, literal
+		}
+	}
+	if email == nil {
+		return nil, nil, fmt.Errorf("email not found, it could be moved or deleted")
+	}
+	return email, body, nil
+}
+
+// sendAttachments uploads email attachments to user as documents. Returns report for user.
+func (handler *EmailBoxHandler) sendAttachments(src MailSource, folder string, uid uint32) (string, error) {
+	_, body, err := fetchRawEmail(src, folder, uid)
+	if err != nil {
+		return "", err
+	}
+	attachments, skipped, err := ExtractAttachments(body)
+	if err != nil {
+		if len(attachments) == 0 {
+			return "", err
+		}
+		skipped = append(skipped, fmt.Sprintf("rest of email (%v)", err))
+	}
+	sent := 0
+	for _, attachment := range attachments {
+		if err := handler.SendDocumentToUser(attachment.Name, attachment.Data); err != nil {
+			skipped = append(skipped, fmt.Sprintf("%s (%v)", attachment.Name, err))
+			continue
+		}
+		sent += 1
+	}
+	if sent == 0 && len(skipped) == 0 {
+		return "Email has no attachments", nil
+	}
+	report := fmt.Sprintf("Sent %d attachments", sent)
+	if len(skipped) > 0 {
+		report += "\nSkipped:\n" + strings.Join(skipped, "\n")
+	}
+	return report, nil
+}
+
+// sendEml uploads whole email to user as .eml file
+func (handler *EmailBoxHandler) sendEml(src MailSource, folder string, uid uint32) (string, error) {
+	email, body, err := fetchRawEmail(src, folder, uid)
+	if err != nil {
+		return "", err
+	}
+	if body.Len() > telegramFileLimit {
+		return "Email is larger than 50 MB and can't be sent to Telegram", nil
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	filename := "email"
+	if email.Envelope != nil {
+		if subject := strings.TrimSpace(unsafeFilenameRegexp.ReplaceAllString(email.Envelope.Subject, "_")); subject != "" {
+			filename = truncateRunes(subject, 60)
+		}
+	}
+	if err := handler.SendDocumentToUser(filename+".eml", data); err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+// SendDocumentToUser uploads file to user's chat
+func (handler *EmailBoxHandler) SendDocumentToUser(name string, data []byte) error {
+	_, err := handler.messenger.SendDocument(handler.user.ChatID, name, data)
+	return err
+}
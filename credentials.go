@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+const (
+	masterKeyEnv    = "TGMAILBOT_MASTER_KEY"
+	newMasterKeyEnv = "TGMAILBOT_NEW_MASTER_KEY"
+)
+
+var MasterKey = flag.String("masterkey", "", "Master key for encrypting mailbox passwords (or "+masterKeyEnv+" env)")
+
+// credentials used for sealing and opening mailbox passwords, set up in main
+var credentials *CredentialCipher
+
+// CredentialCipher seals mailbox passwords with AES-GCM using key derived from master key
+type CredentialCipher struct {
+	aead cipher.AEAD
+}
+
+func NewCredentialCipher(masterKey string) (*CredentialCipher, error) {
+	if masterKey == "" {
+		return nil, fmt.Errorf("master key is empty")
+	}
+	key := sha256.Sum256([]byte(masterKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &CredentialCipher{aead: aead}, nil
+}
+
+// Seal encrypts password and returns base64 encoded nonce with ciphertext
+func (c *CredentialCipher) Seal(password string) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("error generating nonce: %v", err)
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(password), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts password sealed with Seal
+func (c *CredentialCipher) Open(sealedPassword string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(sealedPassword)
+	if err != nil {
+		return "", fmt.Errorf("error decoding sealed password: %v", err)
+	}
+	nonceSize := c.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", fmt.Errorf("sealed password is too short")
+	}
+	password, err := c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting password: %v", err)
+	}
+	return string(password), nil
+}
+
+// RotateMasterKey re-encrypts passwords of all stored accounts with new cipher.
+// All passwords are decrypted before anything is written, so wrong old key leaves storage untouched.
+func RotateMasterKey(storage Storage, oldCipher, newCipher *CredentialCipher) (int, error) {
+	users, err := storage.LoadUsers()
+	if err != nil {
+		return 0, err
+	}
+	accountsCount := 0
+	for _, user := range users {
+		for _, boxHandler := range user.emailBoxHandlers {
+			account := boxHandler.eAccount
+			password, err := oldCipher.Open(account.password)
+			if err != nil {
+				return 0, fmt.Errorf("account %s of user %d: %v", account.login, user.ID, err)
+			}
+			account.password, err = newCipher.Seal(password)
+			if err != nil {
+				return 0, fmt.Errorf("account %s of user %d: %v", account.login, user.ID, err)
+			}
+			if account.smtpPassword != "" {
+				smtpPassword, err := oldCipher.Open(account.smtpPassword)
+				if err != nil {
+					return 0, fmt.Errorf("SMTP password of account %s of user %d: %v", account.login, user.ID, err)
+				}
+				account.smtpPassword, err = newCipher.Seal(smtpPassword)
+				if err != nil {
+					return 0, fmt.Errorf("SMTP password of account %s of user %d: %v", account.login, user.ID, err)
+				}
+			}
+			accountsCount += 1
+		}
+	}
+	if err := storage.SaveUsers(users); err != nil {
+		return 0, err
+	}
+	return accountsCount, nil
+}
+
+// runRotateKeyCommand handles "rotatekey" subcommand: app -masterkey=<old> rotatekey -newkey=<new>
+func runRotateKeyCommand(args []string) {
+	rotateFlags := flag.NewFlagSet("rotatekey", flag.ExitOnError)
+	newKey := rotateFlags.String("newkey", "", "New master key (or "+newMasterKeyEnv+" env)")
+	rotateFlags.Parse(args)
+	if *newKey == "" {
+		*newKey = os.Getenv(newMasterKeyEnv)
+	}
+	newCipher, err := NewCredentialCipher(*newKey)
+	if err != nil {
+		log.Println("New master key is required.", err)
+		return
+	}
+
+	storage, err := NewBoltStorage(*DBPath)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer storage.Close()
+
+	accountsCount, err := RotateMasterKey(storage, credentials, newCipher)
+	if err != nil {
+		log.Println("Error rotating master key.", err)
+		return
+	}
+	log.Printf("Master key rotated for %d accounts", accountsCount)
+}
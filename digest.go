@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"github.com/emersion/go-imap"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// digestCheckT is how often due digests are checked
+const digestCheckT = time.Minute
+
+// digestTopSubjects is how many subjects are shown for every sender in digest
+const digestTopSubjects = 3
+
+const digestScheduleHelp = "Write interval in minutes (for example 30 or 2h), times of day (for example 09:00, 18:00) " +
+	"or \"off\" to send notifications immediately."
+
+// DigestSchedule sets when buffered notifications are sent as one digest message:
+// every IntervalMin minutes or at fixed times of day (HH:MM, local time of bot)
+type DigestSchedule struct {
+	IntervalMin int
+	Times       []string
+}
+
+// ParseDigestSchedule parses schedule written by user: interval like "30", "30m" or "2h",
+// or comma separated times of day like "09:00, 18:00". "off" disables digest and returns nil.
+func ParseDigestSchedule(text string) (*DigestSchedule, error) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	if text == "" || text == "off" {
+		return nil, nil
+	}
+	if strings.Contains(text, ":") {
+		schedule := &DigestSchedule{}
+		for _, part := range strings.Split(text, ",") {
+			t, err := time.Parse("15:04", strings.TrimSpace(part))
+			if err != nil {
+				return nil, fmt.Errorf("wrong time %q, use HH:MM", strings.TrimSpace(part))
+			}
+			schedule.Times = append(schedule.Times, t.Format("15:04"))
+		}
+		sort.Strings(schedule.Times)
+		return schedule, nil
+	}
+	minutes, err := strconv.Atoi(text)
+	if err != nil {
+		interval, err := time.ParseDuration(text)
+		if err != nil {
+			return nil, fmt.Errorf("wrong interval %q", text)
+		}
+		minutes = int(interval / time.Minute)
+	}
+	if minutes < 1 {
+		return nil, fmt.Errorf("interval must be at least 1 minute")
+	}
+	return &DigestSchedule{IntervalMin: minutes}, nil
+}
+
+// spec returns schedule in format accepted by ParseDigestSchedule
+func (s *DigestSchedule) spec() string {
+	if s == nil {
+		return ""
+	}
+	if len(s.Times) > 0 {
+		return strings.Join(s.Times, ", ")
+	}
+	return strconv.Itoa(s.IntervalMin) + "m"
+}
+
+func (s *DigestSchedule) String() string {
+	if s == nil {
+		return "immediately"
+	}
+	if len(s.Times) > 0 {
+		return "digest at " + strings.Join(s.Times, ", ")
+	}
+	return fmt.Sprintf("digest every %d min", s.IntervalMin)
+}
+
+// next returns time when digest started at after should be sent
+func (s *DigestSchedule) next(after time.Time) time.Time {
+	if len(s.Times) == 0 {
+		return after.Add(time.Duration(s.IntervalMin) * time.Minute)
+	}
+	var next time.Time
+	for _, dayTime := range s.Times {
+		t, err := time.Parse("15:04", dayTime)
+		if err != nil {
+			continue
+		}
+		at := time.Date(after.Year(), after.Month(), after.Day(), t.Hour(), t.Minute(), 0, 0, after.Location())
+		if !at.After(after) {
+			at = at.AddDate(0, 0, 1)
+		}
+		if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	if next.IsZero() {
+		return after.Add(24 * time.Hour)
+	}
+	return next
+}
+
+// DigestEntry is email buffered for digest
+type DigestEntry struct {
+	Account string
+	From    string
+	Subject string
+}
+
+// DigestBatch is digest waiting to be sent. Emails with same schedule are collected in one batch.
+type DigestBatch struct {
+	Schedule string
+	Due      time.Time
+	Entries  []*DigestEntry
+}
+
+// digestQueue keeps user's batches, shared between fetching workers and digest sender
+type digestQueue struct {
+	mu      sync.Mutex
+	batches []*DigestBatch
+}
+
+// add buffers entry in batch of schedule. New batch is due at next scheduled time.
+func (q *digestQueue) add(schedule *DigestSchedule, entry *DigestEntry, now time.Time) {
+	q.addBatch(schedule.String(), schedule.next(now), entry)
+}
+
+// addBatch buffers entry in batch with key. Due time is set only if batch is new.
+func (q *digestQueue) addBatch(key string, due time.Time, entry *DigestEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, batch := range q.batches {
+		if batch.Schedule == key {
+			batch.Entries = append(batch.Entries, entry)
+			return
+		}
+	}
+	q.batches = append(q.batches, &DigestBatch{Schedule: key, Due: due, Entries: []*DigestEntry{entry}})
+}
+
+// takeDue removes and returns batches which should be sent at now
+func (q *digestQueue) takeDue(now time.Time) []*DigestBatch {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	due := make([]*DigestBatch, 0)
+	waiting := q.batches[:0]
+	for _, batch := range q.batches {
+		if !batch.Due.After(now) {
+			due = append(due, batch)
+		} else {
+			waiting = append(waiting, batch)
+		}
+	}
+	q.batches = waiting
+	return due
+}
+
+// snapshot returns copy of batches for storage
+func (q *digestQueue) snapshot() []*DigestBatch {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	batches := make([]*DigestBatch, 0, len(q.batches))
+	for _, batch := range q.batches {
+		batchCopy := *batch
+		batchCopy.Entries = append([]*DigestEntry(nil), batch.Entries...)
+		batches = append(batches, &batchCopy)
+	}
+	return batches
+}
+
+func (q *digestQueue) restore(batches []*DigestBatch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.batches = batches
+}
+
+// digestSchedule returns schedule for email matched by pattern: schedule of pattern if set,
+// otherwise schedule of account. Nil means notification is sent immediately, urgent notifications and
+// notifications which require acknowledgement are never buffered.
+func (handler *EmailBoxHandler) digestSchedule(pattern *NotifyPatterns) *DigestSchedule {
+	if pattern != nil && (pattern.Priority == priorityUrgent || pattern.RequiresAck) {
+		return nil
+	}
+	if pattern != nil && pattern.Digest != nil {
+		return pattern.Digest
+	}
+	if handler.eAccount == nil {
+		return nil
+	}
+	return handler.eAccount.digest
+}
+
+// addToDigest buffers email for digest instead of sending notification
+func (handler *EmailBoxHandler) addToDigest(schedule *DigestSchedule, msg *imap.Message) {
+	handler.user.digests.add(schedule, newDigestEntry(handler.eAccount.login, msg), time.Now())
+}
+
+func newDigestEntry(account string, msg *imap.Message) *DigestEntry {
+	entry := &DigestEntry{Account: account}
+	if msg.Envelope != nil {
+		entry.Subject = msg.Envelope.Subject
+		from := make([]string, 0, len(msg.Envelope.From))
+		for _, addr := range msg.Envelope.From {
+			// Digest is sent as plain text, so address is not escaped
+			sender := addressEmail(addr)
+			if addr.PersonalName != "" {
+				sender = truncateRunes(addr.PersonalName, headerValueLimit) + " <" + sender + ">"
+			}
+			from = append(from, sender)
+		}
+		entry.From = strings.Join(from, ", ")
+	}
+	return entry
+}
+
+// formatDigest returns digest message: emails grouped by account and sender with counts and top subjects
+func formatDigest(batch *DigestBatch) string {
+	type senderGroup struct {
+		from     string
+		count    int
+		subjects map[string]int
+		order    []string
+	}
+	accounts := make([]string, 0)
+	groups := make(map[string][]*senderGroup)
+	for _, entry := range batch.Entries {
+		senders, ok := groups[entry.Account]
+		if !ok {
+			accounts = append(accounts, entry.Account)
+		}
+		var group *senderGroup
+		for _, sender := range senders {
+			if sender.from == entry.From {
+				group = sender
+				break
+			}
+		}
+		if group == nil {
+			group = &senderGroup{from: entry.From, subjects: make(map[string]int)}
+			groups[entry.Account] = append(senders, group)
+		}
+		group.count += 1
+		if group.subjects[entry.Subject] == 0 {
+			group.order = append(group.order, entry.Subject)
+		}
+		group.subjects[entry.Subject] += 1
+	}
+
+	title := "Digest"
+	if batch.Schedule == quietHoursBatch {
+		title = "During quiet hours"
+	}
+	text := fmt.Sprintf("%s: %d new emails\n", title, len(batch.Entries))
+	for _, account := range accounts {
+		senders := groups[account]
+		sort.SliceStable(senders, func(i, j int) bool { return senders[i].count > senders[j].count })
+		count := 0
+		for _, sender := range senders {
+			count += sender.count
+		}
+		text += fmt.Sprintf("\n%s (%d)\n", account, count)
+		for _, sender := range senders {
+			sort.SliceStable(sender.order, func(i, j int) bool {
+				return sender.subjects[sender.order[i]] > sender.subjects[sender.order[j]]
+			})
+			from := sender.from
+			if from == "" {
+				from = "unknown sender"
+			}
+			text += fmt.Sprintf("• %s: %d\n", from, sender.count)
+			for i, subject := range sender.order {
+				if i == digestTopSubjects {
+					text += fmt.Sprintf("    and %d more subjects\n", len(sender.order)-i)
+					break
+				}
+				n := sender.subjects[subject]
+				if subject == "" {
+					subject = "(no subject)"
+				}
+				text += "    " + truncateRunes(subject, 80)
+				if n > 1 {
+					text += fmt.Sprintf(" ×%d", n)
+				}
+				text += "\n"
+			}
+		}
+	}
+	return truncateRunes(text, telegramMessageLimit)
+}
+
+// SendDueDigests sends user's digests which are due at now. Digests are sent without sound during quiet hours.
+func (u *StoredUser) SendDueDigests(now time.Time) {
+	batches := u.digests.takeDue(now)
+	if len(batches) == 0 {
+		return
+	}
+	_, quiet := u.QuietHours.end(now)
+	for _, batch := range batches {
+		msg := tgbotapi.NewMessage(u.ChatID, formatDigest(batch))
+		msg.DisableWebPagePreview = true
+		msg.DisableNotification = quiet
+		if _, err := u.messenger.Send(msg); err != nil {
+			log.Println("Error sending digest to user. ", err)
+			// Digest is sent again on next check
+			for _, entry := range batch.Entries {
+				u.digests.addBatch(batch.Schedule, now.Add(digestCheckT), entry)
+			}
+		}
+	}
+	u.Save()
+}
+
+// SendScheduledNotifications sends due digests and reminders of unacknowledged notifications. It is called
+// from update loop every digestCheckT, so user's settings aren't changed by dialogs at the same time.
+func (mgr *UserManager) SendScheduledNotifications(now time.Time) {
+	for _, user := range mgr.users() {
+		user.mu.Lock()
+		user.SendDueDigests(now)
+		user.ResendUnacknowledged(now)
+		user.mu.Unlock()
+	}
+}
@@ -0,0 +1,772 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	e2eIMAPHost    = "imap.e2e.test"
+	e2eLogin       = "test@e2e.test"
+	e2ePassword    = "Test123"
+	e2eUserID      = 7
+	e2eChatID      = 7007
+	e2eWaitTimeout = 10 * time.Second
+)
+
+// e2eBackend is in-memory IMAP backend for end-to-end tests. Memory backend of go-imap isn't safe
+// for concurrent use, so all calls are serialized. New emails are announced to idling clients.
+type e2eBackend struct {
+	mu      sync.Mutex
+	user    backend.User
+	updates chan backend.Update
+}
+
+func newE2EBackend() *e2eBackend {
+	// Memory backend has one user with predefined credentials, bot logs in with its own
+	user, err := memory.New().Login(nil, "username", "password")
+	if err != nil {
+		panic(err)
+	}
+	return &e2eBackend{user: user, updates: make(chan backend.Update, 10)}
+}
+
+func (be *e2eBackend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	if username != e2eLogin || password != e2ePassword {
+		return nil, fmt.Errorf("bad username or password")
+	}
+	return &e2eUser{be: be}, nil
+}
+
+func (be *e2eBackend) Updates() <-chan backend.Update {
+	return be.updates
+}
+
+// e2eEmail returns raw text email sent to test account
+func e2eEmail(from, subject, body string) string {
+	return "From: " + from + "\r\n" +
+		"To: " + e2eLogin + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" + body
+}
+
+// deliver adds emails to INBOX and notifies clients which selected it. Emails are announced by one update,
+// because IMAP server of go-imap doesn't synchronize sending updates with SELECT command.
+func (be *e2eBackend) deliver(emails ...string) error {
+	be.mu.Lock()
+	mbox, err := be.user.GetMailbox(defaultFolder)
+	for _, raw := range emails {
+		if err == nil {
+			err = mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(raw))
+		}
+	}
+	var status *imap.MailboxStatus
+	if err == nil {
+		status, err = mbox.Status([]imap.StatusItem{imap.StatusMessages})
+	}
+	be.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	be.updates <- &backend.MailboxUpdate{Update: backend.NewUpdate(be.user.Username(), defaultFolder), MailboxStatus: status}
+	return nil
+}
+
+type e2eUser struct {
+	be *e2eBackend
+}
+
+func (u *e2eUser) Username() string {
+	return u.be.user.Username()
+}
+
+func (u *e2eUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	u.be.mu.Lock()
+	defer u.be.mu.Unlock()
+	mailboxes, err := u.be.user.ListMailboxes(subscribed)
+	for i, mbox := range mailboxes {
+		mailboxes[i] = &e2eMailbox{be: u.be, mbox: mbox}
+	}
+	return mailboxes, err
+}
+
+func (u *e2eUser) GetMailbox(name string) (backend.Mailbox, error) {
+	u.be.mu.Lock()
+	defer u.be.mu.Unlock()
+	mbox, err := u.be.user.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &e2eMailbox{be: u.be, mbox: mbox}, nil
+}
+
+func (u *e2eUser) CreateMailbox(name string) error {
+	u.be.mu.Lock()
+	defer u.be.mu.Unlock()
+	return u.be.user.CreateMailbox(name)
+}
+
+func (u *e2eUser) DeleteMailbox(name string) error {
+	u.be.mu.Lock()
+	defer u.be.mu.Unlock()
+	return u.be.user.DeleteMailbox(name)
+}
+
+func (u *e2eUser) RenameMailbox(existingName, newName string) error {
+	u.be.mu.Lock()
+	defer u.be.mu.Unlock()
+	return u.be.user.RenameMailbox(existingName, newName)
+}
+
+func (u *e2eUser) Logout() error {
+	return nil
+}
+
+type e2eMailbox struct {
+	be   *e2eBackend
+	mbox backend.Mailbox
+}
+
+func (m *e2eMailbox) Name() string {
+	return m.mbox.Name()
+}
+
+func (m *e2eMailbox) Info() (*imap.MailboxInfo, error) {
+	m.be.mu.Lock()
+	defer m.be.mu.Unlock()
+	return m.mbox.Info()
+}
+
+func (m *e2eMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	m.be.mu.Lock()
+	defer m.be.mu.Unlock()
+	return m.mbox.Status(items)
+}
+
+func (m *e2eMailbox) SetSubscribed(subscribed bool) error {
+	m.be.mu.Lock()
+	defer m.be.mu.Unlock()
+	return m.mbox.SetSubscribed(subscribed)
+}
+
+func (m *e2eMailbox) Check() error {
+	return nil
+}
+
+func (m *e2eMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	m.be.mu.Lock()
+	defer m.be.mu.Unlock()
+	return m.mbox.ListMessages(uid, seqset, items, ch)
+}
+
+func (m *e2eMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	m.be.mu.Lock()
+	defer m.be.mu.Unlock()
+	return m.mbox.SearchMessages(uid, criteria)
+}
+
+func (m *e2eMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	m.be.mu.Lock()
+	defer m.be.mu.Unlock()
+	return m.mbox.CreateMessage(flags, date, body)
+}
+
+func (m *e2eMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
+	m.be.mu.Lock()
+	defer m.be.mu.Unlock()
+	return m.mbox.UpdateMessagesFlags(uid, seqset, operation, flags)
+}
+
+func (m *e2eMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	m.be.mu.Lock()
+	defer m.be.mu.Unlock()
+	return m.mbox.CopyMessages(uid, seqset, dest)
+}
+
+func (m *e2eMailbox) Expunge() error {
+	m.be.mu.Lock()
+	defer m.be.mu.Unlock()
+	return m.mbox.Expunge()
+}
+
+// e2eDialer connects to test IMAP server instead of resolving account's host
+type e2eDialer struct {
+	IMAPDialer
+	addr string
+}
+
+func (d e2eDialer) Dial(host string) (MailSource, error) {
+	if host != e2eIMAPHost+":993" {
+		return nil, fmt.Errorf("unknown host %s", host)
+	}
+	return d.IMAPDialer.Dial(d.addr)
+}
+
+// startE2EIMAPServer serves IMAP over TLS on local port and returns dialer connecting to it
+func startE2EIMAPServer(t *testing.T, imapServer *server.Server) e2eDialer {
+	cert, pool, err := newTestCertificate(e2eIMAPHost)
+	if err != nil {
+		t.Fatalf("Error generating certificate: %v", err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Error starting IMAP server: %v", err)
+	}
+	go imapServer.Serve(listener)
+	t.Cleanup(func() { imapServer.Close() })
+	return e2eDialer{IMAPDialer: IMAPDialer{TLSConfig: &tls.Config{RootCAs: pool, ServerName: e2eIMAPHost}}, addr: listener.Addr().String()}
+}
+
+// newTestCertificate generates self-signed certificate for host and returns pool which trusts it
+func newTestCertificate(host string) (tls.Certificate, *x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool, nil
+}
+
+// fakeTelegram is fake Telegram Bot API server. It returns queued updates to bot and records bot's requests.
+type fakeTelegram struct {
+	mu            sync.Mutex
+	updates       []tgbotapi.Update
+	lastUpdateID  int
+	lastMessageID int
+	sent          []url.Values
+	deleted       []string
+}
+
+func (tg *fakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	var result interface{} = true
+	switch method {
+	case "getMe":
+		result = tgbotapi.User{ID: 1, FirstName: "TGMailBot", UserName: "tgmailbot_e2e", IsBot: true}
+	case "getUpdates":
+		offset, _ := strconv.Atoi(r.Form.Get("offset"))
+		result = tg.takeUpdates(offset)
+	case "sendMessage":
+		chatID, _ := strconv.ParseInt(r.Form.Get("chat_id"), 10, 64)
+		tg.mu.Lock()
+		tg.sent = append(tg.sent, r.Form)
+		tg.lastMessageID += 1
+		result = tgbotapi.Message{MessageID: tg.lastMessageID, Chat: &tgbotapi.Chat{ID: chatID, Type: "private"}, Text: r.Form.Get("text")}
+		tg.mu.Unlock()
+	case "deleteMessage":
+		tg.mu.Lock()
+		tg.deleted = append(tg.deleted, r.Form.Get("message_id"))
+		tg.mu.Unlock()
+	case "answerCallbackQuery", "pinChatMessage", "unpinChatMessage":
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "description": "Unknown method " + method})
+		return
+	}
+	data, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tgbotapi.APIResponse{Ok: true, Result: data})
+}
+
+// takeUpdates waits a bit for new updates like long polling does
+func (tg *fakeTelegram) takeUpdates(offset int) []tgbotapi.Update {
+	deadline := time.Now().Add(50 * time.Millisecond)
+	for {
+		tg.mu.Lock()
+		updates := make([]tgbotapi.Update, 0)
+		for _, update := range tg.updates {
+			if update.UpdateID >= offset {
+				updates = append(updates, update)
+			}
+		}
+		tg.updates = updates
+		tg.mu.Unlock()
+		if len(updates) > 0 || time.Now().After(deadline) {
+			return updates
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// queue adds update for bot. Returns ID of user's message in update.
+func (tg *fakeTelegram) queue(update tgbotapi.Update) int {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	tg.lastUpdateID += 1
+	update.UpdateID = tg.lastUpdateID
+	messageID := 0
+	if update.Message != nil {
+		messageID = 1000 + update.UpdateID
+		update.Message.MessageID = messageID
+	}
+	tg.updates = append(tg.updates, update)
+	return messageID
+}
+
+// texts returns texts of messages sent by bot
+func (tg *fakeTelegram) texts() []string {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	texts := make([]string, 0, len(tg.sent))
+	for _, values := range tg.sent {
+		texts = append(texts, values.Get("text"))
+	}
+	return texts
+}
+
+// redirectTransport sends requests to fake Telegram server, API endpoint of Telegram library can't be changed
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (rt redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	redirected := req.Clone(req.Context())
+	redirected.URL.Scheme = rt.target.Scheme
+	redirected.URL.Host = rt.target.Host
+	redirected.Host = rt.target.Host
+	return http.DefaultTransport.RoundTrip(redirected)
+}
+
+// e2eHarness runs bot with in-process IMAP server and fake Telegram Bot API server.
+// Updates are handled in one loop like in main, test code can run in the same loop to inspect bot state.
+type e2eHarness struct {
+	t        *testing.T
+	telegram *fakeTelegram
+	mail     *e2eBackend
+	manager  *UserManager
+	calls    chan func()
+	matched  map[int]bool //Bot messages already matched by waitMessage
+}
+
+func newE2EHarness(t *testing.T) *e2eHarness {
+	h := &e2eHarness{t: t, telegram: &fakeTelegram{}, mail: newE2EBackend(), calls: make(chan func()), matched: make(map[int]bool)}
+	var be backend.Backend = h.mail
+	if raceEnabled {
+		// go-imap server reads selected mailbox of connection in update broadcaster without locking,
+		// so new emails aren't announced with race detector
+		be = struct{ backend.Backend }{h.mail}
+	}
+	dialer := startE2EIMAPServer(t, server.New(be))
+
+	telegramServer := httptest.NewServer(h.telegram)
+	t.Cleanup(telegramServer.Close)
+	target, _ := url.Parse(telegramServer.URL)
+	botAPI, err := tgbotapi.NewBotAPIWithClient("e2e-token", &http.Client{Transport: redirectTransport{target: target}})
+	if err != nil {
+		t.Fatalf("Error connecting to fake Telegram: %v", err)
+	}
+
+	storage, err := NewBoltStorage(filepath.Join(t.TempDir(), "e2e.db"))
+	if err != nil {
+		t.Fatalf("Error opening storage: %v", err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	h.manager = &UserManager{BotUsers: map[int]*StoredUser{}, storage: storage, messenger: NewTelegramMessenger(botAPI), mailDialer: dialer}
+
+	u := tgbotapi.NewUpdate(0)
+	updates, err := botAPI.GetUpdatesChan(u)
+	if err != nil {
+		t.Fatalf("Error getting updates: %v", err)
+	}
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case update := <-updates:
+				h.manager.HandleUpdate(update)
+			case call := <-h.calls:
+				call()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	// Email box handlers are stopped while servers are running, so they don't wait for reconnection
+	t.Cleanup(func() {
+		h.stopHandlers()
+		close(stop)
+		botAPI.StopReceivingUpdates()
+	})
+	return h
+}
+
+// stopHandlers stops active email box handlers of all users and waits until they report it
+func (h *e2eHarness) stopHandlers() {
+	stopped := 0
+	h.inLoop(func() {
+		for _, user := range h.manager.users() {
+			user.mu.Lock()
+			for _, boxHandler := range user.emailBoxHandlers {
+				if boxHandler.eAccount.isActive {
+					boxHandler.Stop()
+					stopped += 1
+				}
+			}
+			user.mu.Unlock()
+		}
+	})
+	deadline := time.Now().Add(e2eWaitTimeout)
+	for {
+		reported := 0
+		for _, sent := range h.telegram.texts() {
+			if strings.HasPrefix(sent, "Stopped fetching emails for ") {
+				reported += 1
+			}
+		}
+		if reported >= stopped {
+			return
+		}
+		if time.Now().After(deadline) {
+			h.t.Errorf("Stopped %d email box handlers, %d reported stop", stopped, reported)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// inLoop runs function in update loop and waits for it
+func (h *e2eHarness) inLoop(call func()) {
+	done := make(chan struct{})
+	h.calls <- func() {
+		call()
+		close(done)
+	}
+	<-done
+}
+
+// sendText sends text message from user to bot and returns its message ID
+func (h *e2eHarness) sendText(text string) int {
+	user := &tgbotapi.User{ID: e2eUserID, UserName: "tester"}
+	chat := &tgbotapi.Chat{ID: e2eChatID, Type: "private"}
+	return h.telegram.queue(tgbotapi.Update{Message: &tgbotapi.Message{
+		From: user,
+		Chat: chat,
+		Date: int(time.Now().Unix()),
+		Text: text,
+	}})
+}
+
+// pressButton sends callback query of inline keyboard button
+func (h *e2eHarness) pressButton(data string) {
+	user := &tgbotapi.User{ID: e2eUserID, UserName: "tester"}
+	chat := &tgbotapi.Chat{ID: e2eChatID, Type: "private"}
+	h.telegram.queue(tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+		ID:      "callback-" + data,
+		From:    user,
+		Message: &tgbotapi.Message{Chat: chat},
+		Data:    data,
+	}})
+}
+
+// waitMessage waits until bot sends message containing text which wasn't matched before
+func (h *e2eHarness) waitMessage(text string) string {
+	h.t.Helper()
+	deadline := time.Now().Add(e2eWaitTimeout)
+	for {
+		texts := h.telegram.texts()
+		for i, sent := range texts {
+			if !h.matched[i] && strings.Contains(sent, text) {
+				h.matched[i] = true
+				return sent
+			}
+		}
+		if time.Now().After(deadline) {
+			h.t.Fatalf("Bot didn't send message with %q. Sent messages:\n%s", text, strings.Join(texts, "\n---\n"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitCursor waits until account starts tracking folder, emails delivered before aren't notified
+func (h *e2eHarness) waitCursor(login string, folder string) {
+	h.t.Helper()
+	deadline := time.Now().Add(e2eWaitTimeout)
+	for {
+		tracked := false
+		h.inLoop(func() {
+			for _, user := range h.manager.users() {
+				if boxHandler := user.findEmailBoxHandlerByLogin(login, ""); boxHandler != nil {
+					_, tracked = boxHandler.eAccount.folderCursor(folder)
+				}
+			}
+		})
+		if tracked {
+			return
+		}
+		if time.Now().After(deadline) {
+			h.t.Fatalf("Account %s doesn't track folder %s", login, folder)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEndToEnd(t *testing.T) {
+	h := newE2EHarness(t)
+
+	type tCase struct {
+		text     string //Text message from user
+		button   string //Inline keyboard button pressed by user
+		wantText string //Bot's reply must contain
+	}
+	steps := []tCase{
+		{text: AddAccount, wantText: "Enter email address"},
+		{text: e2eLogin, wantText: "Successfully added login"},
+		{text: e2eIMAPHost + ":993", wantText: "Successfully added imap host"},
+		{text: e2ePassword, wantText: "Successfully added password"},
+		{text: "1", wantText: "Account created"},
+		{text: ChangePattern, wantText: "Select which pattern to change"},
+		{button: "newpattern", wantText: "Choose for which field"},
+		{button: "nsbj", wantText: "Choose how to match subject"},
+		{button: "pm_" + matchContains, wantText: "Please write pattern text for"},
+		{text: "invoice", wantText: "New pattern:"},
+		{button: "psave", wantText: "New pattern saved"},
+	}
+	passwordMessageID := 0
+	for i, step := range steps {
+		if step.button != "" {
+			h.pressButton(step.button)
+		} else {
+			messageID := h.sendText(step.text)
+			if step.text == e2ePassword {
+				passwordMessageID = messageID
+			}
+		}
+		if sent := h.waitMessage(step.wantText); sent == "" {
+			t.Errorf("[%d] Bot didn't reply with %q", i, step.wantText)
+		}
+	}
+	h.waitMessage("Successfully connected to mailbox for " + e2eLogin)
+
+	h.telegram.mu.Lock()
+	deleted := append([]string(nil), h.telegram.deleted...)
+	h.telegram.mu.Unlock()
+	if len(deleted) != 1 || deleted[0] != strconv.Itoa(passwordMessageID) {
+		t.Errorf("Message with password is not deleted. want: %d, deleted: %v", passwordMessageID, deleted)
+	}
+
+	h.waitCursor(e2eLogin, defaultFolder)
+	if raceEnabled {
+		t.Skip("IMAP server doesn't announce new emails with race detector")
+	}
+	err := h.mail.deliver(
+		e2eEmail("News <news@shop.test>", "Weekly newsletter", "Sale!"),
+		e2eEmail("Billing <billing@vendor.test>", "Invoice 42", "Please pay until Friday"))
+	if err != nil {
+		t.Fatalf("Error delivering emails: %v", err)
+	}
+	notification := h.waitMessage("Invoice 42")
+	for _, want := range []string{"New email</b> in " + e2eLogin + " / INBOX", "Billing &lt;billing@vendor.test&gt;", "Please pay until Friday"} {
+		if !strings.Contains(notification, want) {
+			t.Errorf("Notification doesn't contain %q:\n%s", want, notification)
+		}
+	}
+	for _, sent := range h.telegram.texts() {
+		if strings.Contains(sent, "Weekly newsletter") {
+			t.Errorf("User is notified about email which doesn't match pattern:\n%s", sent)
+		}
+	}
+}
+
+// e2eUIDPlus adds UID EXPUNGE to test IMAP server. It expunges all deleted emails, which is enough for tests.
+type e2eUIDPlus struct{}
+
+type e2eUIDExpunge struct {
+	server.Expunge
+}
+
+func (cmd *e2eUIDExpunge) UidHandle(conn server.Conn) error {
+	return cmd.Handle(conn)
+}
+
+func (e2eUIDPlus) Capabilities(c server.Conn) []string {
+	return []string{"UIDPLUS"}
+}
+
+func (e2eUIDPlus) Command(name string) server.HandlerFactory {
+	if name != "EXPUNGE" {
+		return nil
+	}
+	return func() server.Handler { return &e2eUIDExpunge{} }
+}
+
+func TestIMAPSource_ManyUpdates(t *testing.T) {
+	be := newE2EBackend()
+	emails := make([]string, 150)
+	for i := range emails {
+		emails[i] = e2eEmail("ci@corp.test", fmt.Sprintf("Build #%d", i), "Passed")
+	}
+	if err := be.deliver(emails...); err != nil {
+		t.Fatalf("Error delivering emails: %v", err)
+	}
+	// Without backend updates server sends EXPUNGE responses for every expunged email itself
+	imapServer := server.New(struct{ backend.Backend }{be})
+	imapServer.Enable(e2eUIDPlus{})
+	dialer := startE2EIMAPServer(t, imapServer)
+
+	src, err := dialer.Dial(e2eIMAPHost + ":993")
+	if err != nil {
+		t.Fatalf("Error connecting to IMAP server: %v", err)
+	}
+	if err := src.Login(e2eLogin, e2ePassword); err != nil {
+		t.Fatalf("Error logging in: %v", err)
+	}
+	if !src.SupportsUIDExpunge() {
+		t.Fatalf("UIDPLUS is not supported by test server")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		messages, err := src.FetchLast(defaultFolder, 0, []imap.FetchItem{imap.FetchUid})
+		uids := make([]uint32, 0, len(messages))
+		for _, msg := range messages {
+			uids = append(uids, msg.Uid)
+		}
+		if err == nil {
+			err = src.AddFlags(defaultFolder, uids, imap.DeletedFlag)
+		}
+		if err == nil {
+			err = src.Expunge(defaultFolder, uids)
+		}
+		if err == nil {
+			_, err = src.Status(defaultFolder)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Error expunging emails: %v", err)
+		}
+	case <-time.After(e2eWaitTimeout):
+		// Blocked connection can't logout
+		t.Fatalf("Connection is blocked by unread updates")
+	}
+	src.Logout()
+}
+
+func TestIMAPSource_IdleAfterStatus(t *testing.T) {
+	be := newE2EBackend()
+	if err := be.deliver(e2eEmail("ci@corp.test", "Build failed", "Failed")); err != nil {
+		t.Fatalf("Error delivering email: %v", err)
+	}
+	dialer := startE2EIMAPServer(t, server.New(struct{ backend.Backend }{be}))
+	src, err := dialer.Dial(e2eIMAPHost + ":993")
+	if err != nil {
+		t.Fatalf("Error connecting to IMAP server: %v", err)
+	}
+	if err := src.Login(e2eLogin, e2ePassword); err != nil {
+		t.Fatalf("Error logging in: %v", err)
+	}
+	if _, err := src.Status(defaultFolder); err != nil {
+		t.Fatalf("Error selecting folder: %v", err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- src.(IdleSource).Idle(defaultFolder, stop)
+	}()
+	// Folder state reported by SELECT of Status isn't a change
+	select {
+	case err := <-done:
+		t.Fatalf("Idle is finished without changes: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Errorf("Error stopping idle: %v", err)
+	}
+	src.Logout()
+}
+
+func TestIMAPSource_IdleFlagsUpdate(t *testing.T) {
+	if raceEnabled {
+		t.Skip("go-imap server isn't race free with mailbox updates")
+	}
+	be := newE2EBackend()
+	if err := be.deliver(e2eEmail("ci@corp.test", "Build failed", "Failed")); err != nil {
+		t.Fatalf("Error delivering email: %v", err)
+	}
+	// Announcement of delivered email is dropped, only change of flags must finish IDLE
+	<-be.updates
+	dialer := startE2EIMAPServer(t, server.New(be))
+	src, err := dialer.Dial(e2eIMAPHost + ":993")
+	if err != nil {
+		t.Fatalf("Error connecting to IMAP server: %v", err)
+	}
+	if err := src.Login(e2eLogin, e2ePassword); err != nil {
+		t.Fatalf("Error logging in: %v", err)
+	}
+	if _, err := src.Status(defaultFolder); err != nil {
+		t.Fatalf("Error selecting folder: %v", err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- src.(IdleSource).Idle(defaultFolder, stop)
+	}()
+	// Email is read in other client
+	msg := imap.NewMessage(1, []imap.FetchItem{imap.FetchFlags})
+	msg.Flags = []string{imap.SeenFlag}
+	be.updates <- &backend.MessageUpdate{Update: backend.NewUpdate(be.user.Username(), defaultFolder), Message: msg}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Error idling: %v", err)
+		}
+	case <-time.After(e2eWaitTimeout):
+		t.Errorf("Idle isn't finished by changed flags")
+		close(stop)
+		<-done
+	}
+	src.Logout()
+}
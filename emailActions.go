@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"github.com/emersion/go-imap"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"log"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Callback data of notification buttons: ea:<action>:<account id>:<uid>:<folder>
+// Account id and UID are base36 encoded to fit folder name into 64 bytes limit of Telegram callback data.
+const (
+	emailActionPrefix    = "ea:"
+	callbackDataLimit    = 64
+	defaultArchiveFolder = "Archive"
+	defaultTrashFolder   = "Trash"
+)
+
+const (
+	actionMarkRead    = "rd"
+	actionArchive     = "ar"
+	actionDelete      = "dl"
+	actionFlag        = "fl"
+	actionFullText    = "tx"
+	actionAttachments = "at"
+	actionEml         = "em"
+	actionAcknowledge = "ak"
+)
+
+// EmailRef points to email on server for actions from notification buttons
+type EmailRef struct {
+	AccountID int
+	Folder    string
+	UID       uint32
+}
+
+func encodeEmailAction(action string, ref EmailRef) (string, bool) {
+	data := emailActionPrefix + action + ":" + strconv.FormatInt(int64(ref.AccountID), 36) + ":" +
+		strconv.FormatUint(uint64(ref.UID), 36) + ":" + ref.Folder
+	return data, len(data) <= callbackDataLimit
+}
+
+func parseEmailAction(data string) (string, EmailRef, error) {
+	parts := strings.SplitN(strings.TrimPrefix(data, emailActionPrefix), ":", 4)
+	if len(parts) != 4 || parts[3] == "" {
+		return "", EmailRef{}, fmt.Errorf("wrong email action format: %s", data)
+	}
+	accountID, err := strconv.ParseInt(parts[1], 36, 64)
+	if err != nil {
+		return "", EmailRef{}, fmt.Errorf("wrong account id in email action: %s", data)
+	}
+	uid, err := strconv.ParseUint(parts[2], 36, 32)
+	if err != nil {
+		return "", EmailRef{}, fmt.Errorf("wrong uid in email action: %s", data)
+	}
+	return parts[0], EmailRef{AccountID: int(accountID), Folder: parts[3], UID: uint32(uid)}, nil
+}
+
+// notificationKeyboard returns buttons for actions with email, urgent notifications also get Acknowledge button.
+// Returns false if email reference is too long for callback data, in this case notification is sent without buttons.
+func notificationKeyboard(ref EmailRef, urgent bool) (tgbotapi.InlineKeyboardMarkup, bool) {
+	type button struct {
+		text   string
+		action string
+	}
+	buttons := []button{
+		{"Mark as read", actionMarkRead},
+		{"Flag", actionFlag},
+		{"Archive", actionArchive},
+		{"Delete", actionDelete},
+		{"Show full text", actionFullText},
+		{"Get attachments", actionAttachments},
+		{"Get .eml", actionEml},
+	}
+	if urgent {
+		buttons = append([]button{{"✅ Acknowledge", actionAcknowledge}}, buttons...)
+	}
+	rows := make([][]tgbotapi.InlineKeyboardButton, 0, 5)
+	for i, button := range buttons {
+		data, ok := encodeEmailAction(button.action, ref)
+		if !ok {
+			return tgbotapi.InlineKeyboardMarkup{}, false
+		}
+		if i%2 == 0 {
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow())
+		}
+		rows[len(rows)-1] = append(rows[len(rows)-1], tgbotapi.NewInlineKeyboardButtonData(button.text, data))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...), true
+}
+
+// EmailActionCallback runs action selected with notification button on email in user's mailbox.
+// Actions connect to mail server, so they run in background and send result to user when finished.
+func (h *UserDialogHandler) EmailActionCallback(data string, user *StoredUser) (*tgbotapi.MessageConfig, error) {
+	action, ref, err := parseEmailAction(data)
+	if err != nil {
+		return nil, err
+	}
+	var boxHandler *EmailBoxHandler
+	for _, bHandler := range user.emailBoxHandlers {
+		if bHandler.eAccount.id == ref.AccountID {
+			boxHandler = bHandler
+			break
+		}
+	}
+	if action == actionAcknowledge {
+		rMsg := tgbotapi.NewMessage(user.ChatID, user.Acknowledge(ref))
+		return &rMsg, nil
+	}
+	if boxHandler == nil {
+		rMsg := tgbotapi.NewMessage(user.ChatID, "Account of this email was removed")
+		return &rMsg, nil
+	}
+
+	chatID := user.ChatID
+	go func() {
+		rMsgText, err := boxHandler.RunEmailAction(action, ref)
+		if err != nil {
+			log.Printf("Error running action %s for email %d in %s. %v", action, ref.UID, ref.Folder, err)
+			rMsgText = "Error: " + err.Error()
+		}
+		if rMsgText == "" {
+			return
+		}
+		if _, err := boxHandler.messenger.Send(tgbotapi.NewMessage(chatID, rMsgText)); err != nil {
+			log.Println("Error sending email action result to user. ", err)
+		}
+	}()
+	return nil, nil
+}
+
+// RunEmailAction connects to server and runs action on email. Returns text for user.
+func (handler *EmailBoxHandler) RunEmailAction(action string, ref EmailRef) (string, error) {
+	src, err := handler.Dial()
+	if err != nil {
+		return "", err
+	}
+	defer src.Logout()
+
+	uids := []uint32{ref.UID}
+	switch action {
+	case actionMarkRead:
+		if err := src.AddFlags(ref.Folder, uids, imap.SeenFlag); err != nil {
+			return "", err
+		}
+		return "Email marked as read", nil
+	case actionFlag:
+		if err := src.AddFlags(ref.Folder, uids, imap.FlaggedFlag); err != nil {
+			return "", err
+		}
+		return "Email flagged", nil
+	case actionDelete:
+		return deleteEmail(src, ref.Folder, ref.UID)
+	case actionArchive:
+		archiveFolder, err := findSpecialFolder(src, imap.ArchiveAttr, defaultArchiveFolder)
+		if err != nil {
+			return "", err
+		}
+		if archiveFolder == ref.Folder {
+			return "Email is already in " + archiveFolder, nil
+		}
+		if err := src.Move(ref.Folder, uids, archiveFolder); err != nil {
+			return "", err
+		}
+		return "Email moved to " + archiveFolder, nil
+	case actionFullText:
+		notification, err := fetchEmailNotification(src, ref.Folder, ref.UID)
+		if err != nil {
+			return "", err
+		}
+		text := notification.Preview
+		if text == "" {
+			return "Email has no text", nil
+		}
+		handler.SendLongMessageToUser(text)
+		return "", nil
+	case actionAttachments:
+		return handler.sendAttachments(src, ref.Folder, ref.UID)
+	case actionEml:
+		return handler.sendEml(src, ref.Folder, ref.UID)
+	}
+	return "", fmt.Errorf("unknown action %s", action)
+}
+
+// deleteEmail removes single email, other emails marked deleted in folder are kept.
+// If server can't expunge single email (no UIDPLUS), email is moved to trash instead.
+func deleteEmail(src MailSource, folder string, uid uint32) (string, error) {
+	uids := []uint32{uid}
+	if src.SupportsUIDExpunge() {
+		if err := src.AddFlags(folder, uids, imap.DeletedFlag); err != nil {
+			return "", err
+		}
+		if err := src.Expunge(folder, uids); err != nil {
+			return "", err
+		}
+		return "Email deleted", nil
+	}
+	trashFolder, err := findSpecialFolder(src, imap.TrashAttr, defaultTrashFolder)
+	if err != nil {
+		return "", err
+	}
+	if trashFolder == folder {
+		// Email is left for mail client to expunge
+		if err := src.AddFlags(folder, uids, imap.DeletedFlag); err != nil {
+			return "", err
+		}
+		return "Email marked as deleted", nil
+	}
+	if err := src.Move(folder, uids, trashFolder); err != nil {
+		return "", err
+	}
+	return "Email moved to " + trashFolder, nil
+}
+
+// findSpecialFolder returns folder with special-use attribute (RFC 6154) or default folder if it exists
+func findSpecialFolder(src MailSource, attr string, defaultFolder string) (string, error) {
+	mailboxes, err := src.ListFolders()
+	if err != nil {
+		return "", err
+	}
+	specialFolder := ""
+	defaultExists := false
+	for _, mailbox := range mailboxes {
+		for _, mailboxAttr := range mailbox.Attributes {
+			if mailboxAttr == attr && specialFolder == "" {
+				specialFolder = mailbox.Name
+			}
+		}
+		if mailbox.Name == defaultFolder {
+			defaultExists = true
+		}
+	}
+	if specialFolder != "" {
+		return specialFolder, nil
+	}
+	if defaultExists {
+		return defaultFolder, nil
+	}
+	return "", fmt.Errorf("%s folder not found on server", strings.ToLower(defaultFolder))
+}
+
+// fetchEmailNotification fetches and parses whole email without marking it seen
+func fetchEmailNotification(src MailSource, folder string, uid uint32) (*EmailNotification, error) {
+	email, body, err := fetchRawEmail(src, folder, uid)
+	if err != nil {
+		return nil, err
+	}
+	notification := &EmailNotification{Envelope: email.Envelope, UID: uid}
+	return notification, notification.ParseBody(body)
+}
+
+// SendLongMessageToUser sends text split into several messages if it doesn't fit into Telegram limit.
+// Invalid UTF-8 of badly encoded emails is replaced, so text is split on rune boundaries.
+func (handler *EmailBoxHandler) SendLongMessageToUser(text string) {
+	text = strings.ToValidUTF8(text, string(utf8.RuneError))
+	for text != "" {
+		end, runes := 0, 0
+		for end < len(text) && runes < telegramMessageLimit {
+			_, size := utf8.DecodeRuneInString(text[end:])
+			end += size
+			runes++
+		}
+		handler.SendMessageToUser(text[:end])
+		text = text[end:]
+	}
+}
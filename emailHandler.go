@@ -3,10 +3,9 @@ package main
 import (
 	"fmt"
 	"github.com/emersion/go-imap"
-	"github.com/emersion/go-imap/client"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"log"
-	"strings"
+	"sort"
 	"time"
 )
 
@@ -14,8 +13,8 @@ import (
 type EmailBoxHandler struct {
 	eAccount           *StoredEmailAccount
 	user               *StoredUser
-	lastMsgId          uint32
-	lastMsgTime        int64
+	messenger          Messenger
+	mailDialer         MailDialer
 	isRestart          bool
 	connectionOk       bool
 	imapRetriesCounter int
@@ -25,15 +24,21 @@ type EmailBoxHandler struct {
 
 func NewEmailBoxHandler(eAccount *StoredEmailAccount, user *StoredUser) *EmailBoxHandler {
 	return &EmailBoxHandler{
-		eAccount:    eAccount,
-		user:        user,
-		lastMsgId:   0,
-		lastMsgTime: time.Now().Unix(),
-		stop:        make(chan struct{}, 1),
+		eAccount:   eAccount,
+		user:       user,
+		messenger:  user.messenger,
+		mailDialer: user.mailDialer,
+		stop:       make(chan struct{}, 1),
 	}
 }
 
 func (handler *EmailBoxHandler) StartFetchingEmails() {
+	if handler.eAccount.pushMode {
+		if !handler.WatchMailbox() {
+			return
+		}
+		log.Printf("Server %s doesn't support IDLE, polling every %d min", handler.eAccount.imapHost, handler.eAccount.updateT)
+	}
 	errMsg := ""
 	handler.FetchNewEmails()
 	if !handler.connectionOk {
@@ -67,9 +72,115 @@ MSGGETTINGLOOP:
 	}
 }
 
+// WatchMailbox keeps one authenticated connection and waits for new emails with IMAP IDLE.
+// Returns true if server doesn't support IDLE and polling must be used instead.
+func (handler *EmailBoxHandler) WatchMailbox() bool {
+	errMsg := ""
+	firstConnect := true
+	reconnectT := time.Duration(handler.eAccount.updateT) * time.Minute
+WATCHLOOP:
+	for {
+		src := handler.connect()
+		if src == nil {
+			if firstConnect || !handler.eAccount.isActive {
+				handler.eAccount.isActive = false
+				return false
+			}
+			select {
+			case <-handler.stop:
+				errMsg = handler.stopMessage()
+				break WATCHLOOP
+			case <-time.After(reconnectT):
+				continue
+			}
+		}
+		firstConnect = false
+		idleSrc, ok := src.(IdleSource)
+		if !ok || !idleSrc.SupportsIdle() {
+			src.Logout()
+			return true
+		}
+		stopped, err := handler.idle(idleSrc)
+		src.Logout()
+		if stopped {
+			errMsg = handler.stopMessage()
+			break
+		}
+		log.Printf("IDLE connection for %s closed, reconnecting. %v", handler.eAccount.login, err)
+	}
+
+	log.Println("Stopped worker", handler)
+	if errMsg != "" {
+		handler.SendMessageToUser(errMsg)
+	}
+	return false
+}
+
+// idle fetches new emails and then waits for mailbox updates until handler is stopped or connection fails.
+// IDLE watches only first folder, other monitored folders are checked every update timeout.
+func (handler *EmailBoxHandler) idle(src IdleSource) (bool, error) {
+	folders := handler.eAccount.monitoredFolders()
+	var pollC <-chan time.Time
+	if len(folders) > 1 {
+		ticker := time.NewTicker(time.Duration(handler.eAccount.updateT) * time.Minute)
+		defer ticker.Stop()
+		pollC = ticker.C
+	}
+	for {
+		if err := handler.fetchMessages(src); err != nil {
+			return false, err
+		}
+
+		idleStop := make(chan struct{})
+		idleDone := make(chan error, 1)
+		go func() {
+			idleDone <- src.Idle(folders[0], idleStop)
+		}()
+
+		select {
+		case <-handler.stop:
+			close(idleStop)
+			<-idleDone
+			return true, nil
+		case err := <-idleDone:
+			if err != nil {
+				return false, err
+			}
+		case <-pollC:
+			close(idleStop)
+			if err := <-idleDone; err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+// stopMessage returns message for user about stopped worker. Restart is not reported.
+func (handler *EmailBoxHandler) stopMessage() string {
+	if handler.isRestart {
+		handler.isRestart = false
+		return ""
+	}
+	return "Stopped fetching emails for " + handler.eAccount.login
+}
+
 func (handler *EmailBoxHandler) FetchNewEmails() {
+	src := handler.connect()
+	if src == nil {
+		return
+	}
+	// Don't forget to logout
+	defer src.Logout()
+
+	if err := handler.fetchMessages(src); err != nil {
+		log.Printf("Error fetching emails for %s. %v", handler.eAccount.login, err)
+	}
+}
+
+// connect dials imap server and logs in. Returns nil if connection or authentication failed.
+func (handler *EmailBoxHandler) connect() MailSource {
 	// Connect to server
-	c, err := client.DialTLS(handler.eAccount.imapHost, nil)
+	src, err := handler.mailDialer.Dial(handler.eAccount.imapHost)
 	errMsg := ""
 	if err != nil {
 		log.Printf("Error connecting to imap server %s. %v", handler.eAccount.imapHost, err)
@@ -81,18 +192,28 @@ func (handler *EmailBoxHandler) FetchNewEmails() {
 				handler.imapRetriesCounter)
 			handler.SendMessageToUser(errMsg)
 			handler.connectionOk = false
+			handler.user.saveFromWorker()
 		}
 
-		return
+		return nil
 	}
 	handler.imapRetriesCounter = 0
 
-	// Don't forget to logout
-	defer c.Logout()
+	password, err := credentials.Open(handler.eAccount.password)
+	if err != nil {
+		log.Printf("Error decrypting password for account %s. %v", handler.eAccount.login, err)
+		src.Logout()
+		handler.eAccount.isActive = false
+		handler.connectionOk = false
+		handler.SendMessageToUser(fmt.Sprintf("Cannot decrypt password for account: %s. Please set password again", handler.eAccount.login))
+		handler.user.saveFromWorker()
+		return nil
+	}
 
 	// Login
-	if err := c.Login(handler.eAccount.login, handler.eAccount.password); err != nil {
+	if err := src.Login(handler.eAccount.login, password); err != nil {
 		log.Printf("Error authenticating in account %s. %v", handler.eAccount.login, err)
+		src.Logout()
 		handler.authRetriesCounter += 1
 		if handler.authRetriesCounter == 3 {
 			handler.eAccount.isActive = false
@@ -101,9 +222,10 @@ func (handler *EmailBoxHandler) FetchNewEmails() {
 				handler.authRetriesCounter)
 			handler.connectionOk = false
 			handler.SendMessageToUser(errMsg)
+			handler.user.saveFromWorker()
 		}
 
-		return
+		return nil
 	}
 	handler.authRetriesCounter = 0
 
@@ -112,81 +234,240 @@ func (handler *EmailBoxHandler) FetchNewEmails() {
 		uMsg := fmt.Sprintf("Successfully connected to mailbox for %s", handler.eAccount.login)
 		handler.SendMessageToUser(uMsg)
 	}
+	return src
+}
+
+// fetchMessages checks all monitored folders for new emails and for read emails which wait for acknowledgement.
+// Missing folders are skipped. First folder is checked last, so it stays selected for IDLE and changes
+// received after its check wake IDLE.
+func (handler *EmailBoxHandler) fetchMessages(src MailSource) error {
+	folders := handler.eAccount.monitoredFolders()
+	for i := len(folders) - 1; i >= 0; i-- {
+		folder := folders[i]
+		err := handler.fetchFolderMessages(src, folder)
+		if err == nil {
+			err = handler.checkSeenAcks(src, folder)
+		}
+		if err != nil {
+			if !src.Connected() {
+				return err
+			}
+			log.Printf("Error checking folder %s for %s. %v", folder, handler.eAccount.login, err)
+		}
+	}
+	return nil
+}
 
-	// Select INBOX
-	mbox, err := c.Select("INBOX", false)
+// fetchFolderMessages checks folder for new emails and sends notifications for matching ones
+func (handler *EmailBoxHandler) fetchFolderMessages(src MailSource, folder string) error {
+	status, err := src.Status(folder)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	fmt.Println("Fetching emails")
-	//always get last 20 messages and compare time with of last known
-	from := mbox.Messages - 19
-	to := mbox.Messages
-	seqset := new(imap.SeqSet)
-	seqset.AddRange(from, to)
+	cursor, ok := handler.eAccount.folderCursor(folder)
+	if !ok || cursor.UIDValidity != status.UIDValidity {
+		// First check or UIDs were reset by server: start tracking from current state without notifications
+		if ok {
+			log.Printf("UIDVALIDITY of %s for %s changed from %d to %d, resetting cursor",
+				folder, handler.eAccount.login, cursor.UIDValidity, status.UIDValidity)
+		}
+		handler.eAccount.setFolderCursor(folder, status)
+		handler.user.saveFromWorker()
+		return nil
+	}
+	if status.LastUID <= cursor.LastUID {
+		return nil
+	}
 
-	messages := make(chan *imap.Message, 100)
-	done := make(chan error, 1)
-	go func() {
-		done <- c.Fetch(seqset, []imap.FetchItem{imap.FetchEnvelope}, messages)
-	}()
+	log.Printf("Fetching new emails from %s for %s", folder, handler.eAccount.login)
+	handler.user.mu.Lock()
+	items := append([]imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}, patternsFetchItems(handler.accountPatterns())...)
+	handler.user.mu.Unlock()
+	messages, fetchErr := src.FetchSince(folder, cursor.LastUID, items)
 
-	for msg := range messages {
-		msgTime := msg.Envelope.Date.Unix()
-		if msgTime <= handler.lastMsgTime {
+	lastUID := cursor.LastUID
+	matched := make([]*imap.Message, 0)
+	silent := make(map[uint32]bool)
+	matchedPatterns := make(map[uint32]*NotifyPatterns)
+	now := time.Now()
+	// Patterns and delivery settings are matched while dialogs can't change them
+	handler.user.mu.Lock()
+	for _, msg := range messages {
+		if msg.Uid > lastUID {
+			lastUID = msg.Uid
+		}
+		pattern, notify := handler.MatchPattern(msg)
+		if !notify {
+			continue
+		}
+		if schedule := handler.digestSchedule(pattern); schedule != nil {
+			handler.addToDigest(schedule, msg)
 			continue
 		}
-		handler.lastMsgTime = msgTime
-		if handler.CheckPatterns(msg) {
-			newUserMsg := fmt.Sprintf("At: %s\n", msg.Envelope.Date.Format("2006-01-02 15:04:05"))
-			newUserMsg += fmt.Sprintf("Account: %s\n", handler.eAccount.login)
-			newUserMsg += fmt.Sprintf("From: %s\n", msg.Envelope.From[0].PersonalName)
-			newUserMsg += fmt.Sprintf("Subject: %s\n", msg.Envelope.Subject)
-			handler.SendMessageToUser(newUserMsg)
+		if until, delay, quiet := handler.user.quietDelivery(pattern, now); delay {
+			handler.user.digests.addBatch(quietHoursBatch, until, newDigestEntry(handler.eAccount.login, msg))
+		} else {
+			matched = append(matched, msg)
+			silent[msg.Uid] = quiet
+			if pattern != nil {
+				// Pattern can be edited after lock is released
+				patternCopy := *pattern
+				matchedPatterns[msg.Uid] = &patternCopy
+			}
 		}
 	}
+	handler.user.mu.Unlock()
 
-	if err := <-done; err != nil {
-		newUserMsg := "Error getting emails: " + err.Error()
+	if fetchErr != nil {
+		newUserMsg := "Error getting emails: " + fetchErr.Error()
 		handler.SendMessageToUser(newUserMsg)
 	}
 
-	handler.lastMsgId = mbox.Messages
+	if len(matched) > 0 {
+		notifications := handler.fetchNotifications(src, folder, matched)
+		for _, notification := range notifications {
+			notification.Silent = silent[notification.UID]
+			if pattern := matchedPatterns[notification.UID]; pattern != nil {
+				notification.Priority = pattern.Priority
+				notification.RequiresAck = pattern.RequiresAck
+			}
+			handler.SendNotification(notification)
+		}
+	}
+
+	if lastUID != cursor.LastUID {
+		cursor.LastUID = lastUID
+		handler.eAccount.setFolderCursor(folder, cursor)
+		handler.user.saveFromWorker()
+	}
+	return nil
+}
+
+// fetchNotifications fetches bodies of matched messages without marking them seen and prepares notifications.
+// If bodies can't be fetched notifications are sent without preview.
+func (handler *EmailBoxHandler) fetchNotifications(src MailSource, folder string, matched []*imap.Message) []*EmailNotification {
+	notifications := make([]*EmailNotification, 0, len(matched))
+	byUID := make(map[uint32]*EmailNotification, len(matched))
+	uids := make([]uint32, 0, len(matched))
+	for _, msg := range matched {
+		notification := &EmailNotification{
+			AccountID: handler.eAccount.id,
+			Account:   handler.eAccount.login,
+			Folder:    folder,
+			UID:       msg.Uid,
+			Envelope:  msg.Envelope,
+		}
+		notifications = append(notifications, notification)
+		byUID[msg.Uid] = notification
+		uids = append(uids, msg.Uid)
+	}
+
+	messages, err := src.Fetch(folder, uids, []imap.FetchItem{imap.FetchUid, bodySectionToPeek.FetchItem()})
+	for _, msg := range messages {
+		notification, ok := byUID[msg.Uid]
+		body := msg.GetBody(bodySectionToPeek)
+		if !ok || body == nil {
+			continue
+		}
+		if err := notification.ParseBody(body); err != nil {
+			log.Printf("Error parsing email %d in %s for %s. %v", msg.Uid, folder, handler.eAccount.login, err)
+		}
+	}
+	if err != nil {
+		log.Printf("Error fetching email bodies in %s for %s. %v", folder, handler.eAccount.login, err)
+	}
+	return notifications
 }
 
+// CheckPatterns checks if user should be notified about email. Mute rules are checked first,
+// if there are no other patterns user is notified about all emails which are not muted.
 func (handler *EmailBoxHandler) CheckPatterns(msg *imap.Message) bool {
-	sendEmail := false
-	if len(handler.user.Patterns) == 0 {
-		return true
+	_, notify := handler.MatchPattern(msg)
+	return notify
+}
+
+// MatchPattern returns first user's pattern which email matches and whether user should be notified.
+// Returned pattern is mute rule if email is muted and nil if no pattern matches.
+func (handler *EmailBoxHandler) MatchPattern(msg *imap.Message) (*NotifyPatterns, bool) {
+	ctx := newMatchContext(msg)
+	patterns := handler.accountPatterns()
+	for _, uPattern := range patterns {
+		if uPattern.Exclude && uPattern.match(ctx) {
+			return uPattern, false
+		}
+	}
+	hasInclusions := false
+	for _, uPattern := range patterns {
+		if uPattern.Exclude {
+			continue
+		}
+		hasInclusions = true
+		if uPattern.match(ctx) {
+			return uPattern, true
+		}
+	}
+	return nil, !hasInclusions
+}
+
+// accountPatterns returns user's patterns which are applied to handler's account
+func (handler *EmailBoxHandler) accountPatterns() []*NotifyPatterns {
+	if handler.eAccount == nil {
+		return handler.user.Patterns
 	}
-	msgSubj := strings.ToLower(msg.Envelope.Subject)
+	patterns := make([]*NotifyPatterns, 0, len(handler.user.Patterns))
 	for _, uPattern := range handler.user.Patterns {
-		if uPattern.Subject != "" {
-			if strings.Contains(msgSubj, uPattern.Subject) {
-				sendEmail = true
-				break
-			}
+		if uPattern.appliesTo(handler.eAccount.id) {
+			patterns = append(patterns, uPattern)
 		}
-		if uPattern.FromEmail != "" || uPattern.FromPersonalName != "" {
-			for _, sAddr := range msg.Envelope.From {
-				msgMaiBoxes := strings.ToLower(sAddr.MailboxName)
-				msgPerson := strings.ToLower(sAddr.PersonalName)
-				if msgMaiBoxes == uPattern.FromEmail {
-					sendEmail = true
-					break
-				}
-				if msgPerson == uPattern.FromPersonalName {
-					sendEmail = true
-					break
-				}
-			}
-			if sendEmail {
-				break
+	}
+	return patterns
+}
+
+// Dial connects to imap server and logs in. Used for one-off operations outside of fetching loop.
+func (handler *EmailBoxHandler) Dial() (MailSource, error) {
+	src, err := handler.mailDialer.Dial(handler.eAccount.imapHost)
+	if err != nil {
+		return nil, err
+	}
+	password, err := credentials.Open(handler.eAccount.password)
+	if err != nil {
+		src.Logout()
+		return nil, err
+	}
+	if err := src.Login(handler.eAccount.login, password); err != nil {
+		src.Logout()
+		return nil, err
+	}
+	return src, nil
+}
+
+// ListFolders returns names of all selectable folders in account
+func (handler *EmailBoxHandler) ListFolders() ([]string, error) {
+	src, err := handler.Dial()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Logout()
+
+	mailboxes, err := src.ListFolders()
+	if err != nil {
+		return nil, err
+	}
+	folders := make([]string, 0, len(mailboxes))
+	for _, mailbox := range mailboxes {
+		noSelect := false
+		for _, attr := range mailbox.Attributes {
+			if attr == imap.NoSelectAttr {
+				noSelect = true
 			}
 		}
+		if !noSelect {
+			folders = append(folders, mailbox.Name)
+		}
 	}
-	return sendEmail
+	sort.Strings(folders)
+	return folders, nil
 }
 
 func (handler *EmailBoxHandler) Restart() {
@@ -201,9 +482,45 @@ func (handler *EmailBoxHandler) Stop() {
 	handler.stop <- struct{}{}
 }
 
+// SendNotification sends formatted notification about new email to user. Notifications of low priority
+// are sent without sound, urgent notifications are pinned. Urgent notifications and notifications which
+// require acknowledgement are re-sent until user acknowledges them. Returns false if notification wasn't sent.
+func (handler *EmailBoxHandler) SendNotification(notification *EmailNotification) bool {
+	urgent := notification.Priority == priorityUrgent
+	waitAck := urgent || notification.RequiresAck
+	msg := tgbotapi.NewMessage(handler.user.ChatID, notification.Format())
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.DisableWebPagePreview = true
+	msg.DisableNotification = notification.Silent || notification.Priority == priorityLow
+	ref := notification.ref()
+	if keyboard, ok := notificationKeyboard(ref, waitAck); ok {
+		msg.ReplyMarkup = keyboard
+	} else {
+		log.Printf("Folder name %s is too long for notification buttons", notification.Folder)
+	}
+	sentMsg, err := handler.messenger.Send(msg)
+	if err != nil {
+		log.Println("Error sending notification to user. ", err)
+		return false
+	}
+	handler.user.notifications.add(sentMsg.MessageID, ref)
+	if notification.Reminder > 0 {
+		if !handler.user.acks.update(notification, sentMsg.MessageID, time.Now()) {
+			// Acknowledged while reminder was sent
+			return true
+		}
+	} else if waitAck {
+		handler.user.acks.track(notification, sentMsg.MessageID, time.Now())
+	}
+	if urgent {
+		handler.user.pinMessage(sentMsg.MessageID)
+	}
+	return true
+}
+
 func (handler *EmailBoxHandler) SendMessageToUser(nMsg string) {
 	msg := tgbotapi.NewMessage(handler.user.ChatID, nMsg)
-	_, err := bot.Send(msg)
+	_, err := handler.messenger.Send(msg)
 	if err != nil {
 		log.Println("Error sending message to user. ", err)
 	}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	// importFileLimit is maximum size of uploaded import document
+	importFileLimit    = 1 << 20
+	importFetchTimeout = 30 * time.Second
+)
+
+// exportDocument is user's accounts and patterns for /export and /import. Passwords are never exported.
+type exportDocument struct {
+	Accounts   []*exportAccount `yaml:"accounts" json:"accounts"`
+	Patterns   []*exportPattern `yaml:"patterns" json:"patterns"`
+	QuietHours string           `yaml:"quiet_hours,omitempty" json:"quiet_hours,omitempty"` //Arguments of /quiethours, disabled if empty
+}
+
+type exportAccount struct {
+	Login        string   `yaml:"login" json:"login"`
+	IMAPHost     string   `yaml:"imap_host" json:"imap_host"`
+	UpdateT      int      `yaml:"timeout_min" json:"timeout_min"`
+	Active       bool     `yaml:"active" json:"active"`
+	Push         bool     `yaml:"push" json:"push"`
+	Folders      []string `yaml:"folders" json:"folders"`
+	Digest       string   `yaml:"digest,omitempty" json:"digest,omitempty"` //Digest schedule, notifications are sent immediately if empty
+	SMTPHost     string   `yaml:"smtp_host,omitempty" json:"smtp_host,omitempty"`
+	SMTPSecurity string   `yaml:"smtp_security,omitempty" json:"smtp_security,omitempty"`
+	SMTPLogin    string   `yaml:"smtp_login,omitempty" json:"smtp_login,omitempty"`
+}
+
+type exportPattern struct {
+	ID          int                `yaml:"id" json:"id"`
+	Mute        bool               `yaml:"mute,omitempty" json:"mute,omitempty"`
+	Accounts    []string           `yaml:"accounts,omitempty" json:"accounts,omitempty"` //Logins of accounts, all if empty
+	Digest      string             `yaml:"digest,omitempty" json:"digest,omitempty"`     //Digest schedule, account schedule is used if empty
+	Priority    string             `yaml:"priority,omitempty" json:"priority,omitempty"`
+	RequiresAck bool               `yaml:"requires_ack,omitempty" json:"requires_ack,omitempty"`
+	Conditions  []*exportCondition `yaml:"conditions" json:"conditions"`
+}
+
+type exportCondition struct {
+	Field         string `yaml:"field" json:"field"`
+	Header        string `yaml:"header,omitempty" json:"header,omitempty"`
+	Mode          string `yaml:"mode" json:"mode"`
+	Value         string `yaml:"value" json:"value"`
+	CaseSensitive bool   `yaml:"case_sensitive,omitempty" json:"case_sensitive,omitempty"`
+	Negate        bool   `yaml:"negate,omitempty" json:"negate,omitempty"`
+}
+
+// userImport is validated import document which is shown to user before applying
+type userImport struct {
+	accounts   []*accountImport
+	patterns   []*NotifyPatterns
+	quietHours *QuietHours
+}
+
+type accountImport struct {
+	handler  *EmailBoxHandler
+	settings *exportAccount
+}
+
+func newExportDocument(user *StoredUser) *exportDocument {
+	doc := &exportDocument{
+		Accounts:   make([]*exportAccount, 0, len(user.emailBoxHandlers)),
+		Patterns:   make([]*exportPattern, 0, len(user.Patterns)),
+		QuietHours: user.QuietHours.spec(),
+	}
+	for _, boxHandler := range user.emailBoxHandlers {
+		doc.Accounts = append(doc.Accounts, newExportAccount(boxHandler.eAccount))
+	}
+	for _, uPattern := range user.Patterns {
+		pattern := &exportPattern{
+			ID:          uPattern.ID,
+			Mute:        uPattern.Exclude,
+			Digest:      uPattern.Digest.spec(),
+			Priority:    uPattern.Priority,
+			RequiresAck: uPattern.RequiresAck,
+		}
+		for _, accountID := range uPattern.AccountIDs {
+			if boxHandler := user.findEmailBoxHandler(accountID); boxHandler != nil {
+				pattern.Accounts = append(pattern.Accounts, boxHandler.eAccount.login)
+			}
+		}
+		for _, condition := range uPattern.conditions() {
+			pattern.Conditions = append(pattern.Conditions, &exportCondition{
+				Field:         condition.Field,
+				Header:        condition.Header,
+				Mode:          condition.Mode,
+				Value:         condition.Value,
+				CaseSensitive: condition.CaseSensitive,
+				Negate:        condition.Negate,
+			})
+		}
+		doc.Patterns = append(doc.Patterns, pattern)
+	}
+	return doc
+}
+
+func newExportAccount(account *StoredEmailAccount) *exportAccount {
+	return &exportAccount{
+		Login:        account.login,
+		IMAPHost:     account.imapHost,
+		UpdateT:      account.updateT,
+		Active:       account.isActive,
+		Push:         account.pushMode,
+		Folders:      account.monitoredFolders(),
+		Digest:       account.digest.spec(),
+		SMTPHost:     account.smtpHost,
+		SMTPSecurity: account.smtpSecurity,
+		SMTPLogin:    account.smtpLogin,
+	}
+}
+
+// parseImportDocument reads YAML or JSON document. Unknown fields are reported as errors to catch typos.
+func parseImportDocument(data []byte) (*exportDocument, error) {
+	doc := &exportDocument{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(doc); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("file is empty")
+		}
+		return nil, err
+	}
+	return doc, nil
+}
+
+// toImport validates document and matches its accounts and patterns with user's ones.
+// Accounts can't be created by import because passwords are not exported.
+func (d *exportDocument) toImport(user *StoredUser) (*userImport, error) {
+	imp := &userImport{}
+	errs := make([]string, 0)
+	for i, account := range d.Accounts {
+		boxHandler := user.findEmailBoxHandlerByLogin(account.Login, account.IMAPHost)
+		schedule, scheduleErr := ParseDigestSchedule(account.Digest)
+		switch {
+		case boxHandler == nil:
+			errs = append(errs, fmt.Sprintf("account %s is not added, add it with /addaccount first", account.Login))
+		case account.UpdateT <= 0:
+			errs = append(errs, fmt.Sprintf("account %s: timeout must be positive", account.Login))
+		case account.SMTPSecurity != "" && account.SMTPSecurity != smtpSecurityTLS && account.SMTPSecurity != smtpSecurityStartTLS:
+			errs = append(errs, fmt.Sprintf("account %s: unknown SMTP security %q", account.Login, account.SMTPSecurity))
+		case account.SMTPHost != "" && account.SMTPSecurity == "":
+			errs = append(errs, fmt.Sprintf("account %s: SMTP security is not set", account.Login))
+		case account.SMTPLogin != "" && account.SMTPLogin != boxHandler.eAccount.smtpLogin:
+			errs = append(errs, fmt.Sprintf("account %s: SMTP login can't be changed by import because password is required", account.Login))
+		case scheduleErr != nil:
+			errs = append(errs, fmt.Sprintf("account %s: digest: %v", account.Login, scheduleErr))
+		default:
+			account.Digest = schedule.spec()
+			if len(account.Folders) == 0 {
+				account.Folders = []string{defaultFolder}
+			}
+			for _, other := range d.Accounts[:i] {
+				if other.Login == account.Login && other.IMAPHost == account.IMAPHost {
+					errs = append(errs, fmt.Sprintf("account %s is listed twice", account.Login))
+				}
+			}
+			imp.accounts = append(imp.accounts, &accountImport{handler: boxHandler, settings: account})
+		}
+	}
+
+	ids := make(map[int]bool)
+	newID := int(time.Now().Unix())
+	for i, pattern := range d.Patterns {
+		name := fmt.Sprintf("pattern %d", i+1)
+		if pattern.ID == 0 {
+			for ids[newID] {
+				newID += 1
+			}
+			pattern.ID = newID
+		}
+		if ids[pattern.ID] {
+			errs = append(errs, fmt.Sprintf("%s: id %d is used twice", name, pattern.ID))
+			continue
+		}
+		ids[pattern.ID] = true
+		if len(pattern.Conditions) == 0 {
+			errs = append(errs, name+": no conditions")
+			continue
+		}
+		uPattern := &NotifyPatterns{ID: pattern.ID, Exclude: pattern.Mute}
+		schedule, err := ParseDigestSchedule(pattern.Digest)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: digest: %v", name, err))
+		}
+		uPattern.Digest = schedule
+		if _, ok := priorityNames[pattern.Priority]; !ok {
+			errs = append(errs, fmt.Sprintf("%s: unknown priority %q", name, pattern.Priority))
+		}
+		uPattern.Priority = pattern.Priority
+		uPattern.RequiresAck = pattern.RequiresAck
+		for _, login := range pattern.Accounts {
+			boxHandler := user.findEmailBoxHandlerByLogin(login, "")
+			if boxHandler == nil {
+				errs = append(errs, fmt.Sprintf("%s: unknown account %s", name, login))
+				continue
+			}
+			uPattern.AccountIDs = append(uPattern.AccountIDs, boxHandler.eAccount.id)
+		}
+		for _, condition := range pattern.Conditions {
+			uCondition := &PatternCondition{
+				Field:         condition.Field,
+				Header:        condition.Header,
+				Mode:          condition.Mode,
+				Value:         condition.Value,
+				CaseSensitive: condition.CaseSensitive,
+				Negate:        condition.Negate,
+			}
+			if err := uCondition.Compile(); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			}
+			uPattern.Conditions = append(uPattern.Conditions, uCondition)
+		}
+		imp.patterns = append(imp.patterns, uPattern)
+	}
+	quietHours, err := ParseQuietHours(d.QuietHours)
+	if err != nil {
+		errs = append(errs, "quiet hours: "+err.Error())
+	}
+	imp.quietHours = quietHours
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return imp, nil
+}
+
+// diff describes changes which import makes. Patterns of document replace all user's patterns.
+func (imp *userImport) diff(user *StoredUser) string {
+	lines := make([]string, 0)
+	for _, account := range imp.accounts {
+		current := newExportAccount(account.handler.eAccount)
+		changes := make([]string, 0)
+		currentValue := reflect.ValueOf(*current)
+		newValue := reflect.ValueOf(*account.settings)
+		for i := 0; i < currentValue.NumField(); i++ {
+			if !reflect.DeepEqual(currentValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+				name := strings.Split(currentValue.Type().Field(i).Tag.Get("yaml"), ",")[0]
+				changes = append(changes, fmt.Sprintf("%s: %v → %v", name, currentValue.Field(i).Interface(), newValue.Field(i).Interface()))
+			}
+		}
+		if len(changes) > 0 {
+			lines = append(lines, fmt.Sprintf("~ account %s: %s", current.Login, strings.Join(changes, ", ")))
+		}
+	}
+
+	newPatterns := make(map[int]*NotifyPatterns, len(imp.patterns))
+	for _, pattern := range imp.patterns {
+		newPatterns[pattern.ID] = pattern
+	}
+	for _, uPattern := range user.Patterns {
+		pattern, ok := newPatterns[uPattern.ID]
+		if !ok {
+			lines = append(lines, "- "+describePattern(uPattern, user))
+			continue
+		}
+		if describePattern(uPattern, user) != describePattern(pattern, user) {
+			lines = append(lines, "~ "+describePattern(uPattern, user)+" → "+describePattern(pattern, user))
+		}
+	}
+	for _, pattern := range imp.patterns {
+		found := false
+		for _, uPattern := range user.Patterns {
+			if uPattern.ID == pattern.ID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			lines = append(lines, "+ "+describePattern(pattern, user))
+		}
+	}
+	if imp.quietHours.spec() != user.QuietHours.spec() {
+		lines = append(lines, fmt.Sprintf("~ quiet hours: %s → %s", user.QuietHours, imp.quietHours))
+	}
+	if len(lines) == 0 {
+		return "No changes"
+	}
+	return strings.Join(lines, "\n")
+}
+
+func describePattern(pattern *NotifyPatterns, user *StoredUser) string {
+	text := pattern.String() + " [accounts: " + patternScopeText(pattern, user)
+	if pattern.Digest != nil {
+		text += ", " + pattern.Digest.String()
+	}
+	if pattern.Priority != priorityNormal {
+		text += ", priority " + priorityNames[pattern.Priority]
+	}
+	if pattern.RequiresAck {
+		text += ", requires ack"
+	}
+	return text + "]"
+}
+
+// apply changes account settings and replaces user's patterns with imported ones
+func (imp *userImport) apply(user *StoredUser) {
+	for _, account := range imp.accounts {
+		settings := account.settings
+		eAccount := account.handler.eAccount
+		changed := !reflect.DeepEqual(newExportAccount(eAccount), settings)
+		wasActive := eAccount.isActive
+		eAccount.updateT = settings.UpdateT
+		eAccount.pushMode = settings.Push
+		eAccount.setFolders(settings.Folders)
+		eAccount.digest, _ = ParseDigestSchedule(settings.Digest)
+		eAccount.smtpHost = settings.SMTPHost
+		eAccount.smtpSecurity = settings.SMTPSecurity
+		if settings.SMTPLogin == "" {
+			eAccount.smtpLogin = ""
+			eAccount.smtpPassword = ""
+		}
+		switch {
+		case wasActive && !settings.Active:
+			account.handler.Stop()
+		case !wasActive && settings.Active:
+			eAccount.isActive = true
+			go account.handler.StartFetchingEmails()
+		case wasActive && changed:
+			account.handler.Restart()
+		}
+	}
+	user.Patterns = imp.patterns
+	user.QuietHours = imp.quietHours
+	user.Save()
+}
+
+// ExportHandler sends user's accounts and patterns as YAML document, or JSON if requested with "/export json"
+func (h *UserDialogHandler) ExportHandler(msg string, user *StoredUser) (*tgbotapi.MessageConfig, error) {
+	doc := newExportDocument(user)
+	var data []byte
+	var err error
+	filename := "tgmailbot.yaml"
+	if strings.Contains(strings.ToLower(msg), "json") {
+		filename = "tgmailbot.json"
+		data, err = json.MarshalIndent(doc, "", "  ")
+	} else {
+		data, err = yaml.Marshal(doc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.commandFinished = true
+	if _, err := user.messenger.SendDocument(user.ChatID, filename, data); err != nil {
+		log.Println("Error sending export to user. ", err)
+		rMsg := tgbotapi.NewMessage(user.ChatID, "Error sending export: "+err.Error())
+		return &rMsg, nil
+	}
+	rMsgText := fmt.Sprintf("Exported %d accounts and %d patterns. Passwords are not exported.", len(doc.Accounts), len(doc.Patterns))
+	rMsg := tgbotapi.NewMessage(user.ChatID, rMsgText)
+	return &rMsg, nil
+}
+
+// ImportHandler waits for uploaded document, validates it and shows changes which will be applied
+func (h *UserDialogHandler) ImportHandler(inMsg *tgbotapi.Message, user *StoredUser) (*tgbotapi.MessageConfig, error) {
+	if inMsg.Document == nil {
+		h.lastCommand = "/import"
+		h.pendingImport = nil
+		rMsg := tgbotapi.NewMessage(user.ChatID, "Please send YAML or JSON file in format of /export. "+
+			"Patterns from file replace all current patterns, accounts must be already added.\n"+
+			"Rules of .sieve file are added to current patterns.")
+		return &rMsg, nil
+	}
+	if inMsg.Document.FileSize > importFileLimit {
+		rMsg := tgbotapi.NewMessage(user.ChatID, "File is too large")
+		return &rMsg, nil
+	}
+	data, err := downloadTelegramFile(user.messenger, inMsg.Document.FileID)
+	if err != nil {
+		log.Println("Error downloading import file. ", err)
+		rMsg := tgbotapi.NewMessage(user.ChatID, "Error downloading file: "+err.Error())
+		return &rMsg, nil
+	}
+	var imp *userImport
+	var unsupported []string
+	if strings.HasSuffix(strings.ToLower(inMsg.Document.FileName), ".sieve") {
+		imp, unsupported, err = sieveImport(string(data), user)
+		if err != nil {
+			rMsgText := "Error converting Sieve script: " + err.Error()
+			if len(unsupported) > 0 {
+				rMsgText += "\n\nNot converted:\n" + strings.Join(unsupported, "\n")
+			}
+			rMsg := tgbotapi.NewMessage(user.ChatID, truncateRunes(rMsgText, telegramMessageLimit))
+			return &rMsg, nil
+		}
+	} else {
+		doc, err := parseImportDocument(data)
+		if err != nil {
+			rMsg := tgbotapi.NewMessage(user.ChatID, "Error reading file: "+err.Error())
+			return &rMsg, nil
+		}
+		imp, err = doc.toImport(user)
+		if err != nil {
+			rMsg := tgbotapi.NewMessage(user.ChatID, truncateRunes("File is not valid:\n"+err.Error(), telegramMessageLimit))
+			return &rMsg, nil
+		}
+	}
+	h.pendingImport = imp
+	rMsgText := "Changes:\n" + imp.diff(user)
+	if len(unsupported) > 0 {
+		rMsgText += "\n\nNot converted:\n" + strings.Join(unsupported, "\n")
+	}
+	rMsgText = truncateRunes(rMsgText, telegramMessageLimit-100) + "\n\nApply changes?"
+	rMsg := tgbotapi.NewMessage(user.ChatID, rMsgText)
+	rMsg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Apply", "impapply"),
+			tgbotapi.NewInlineKeyboardButtonData("Cancel", "impcancel"),
+		),
+	)
+	return &rMsg, nil
+}
+
+// ImportCallback applies or cancels import shown to user
+func (h *UserDialogHandler) ImportCallback(data string, user *StoredUser) (*tgbotapi.MessageConfig, error) {
+	rMsgText := "Import cancelled"
+	if data == "impapply" {
+		if h.pendingImport == nil {
+			rMsgText = "Nothing to import, please send file again"
+		} else {
+			h.pendingImport.apply(user)
+			rMsgText = "Import applied"
+		}
+	}
+	h.pendingImport = nil
+	h.lastCommand = ""
+	rMsg := tgbotapi.NewMessage(user.ChatID, rMsgText)
+	return &rMsg, nil
+}
+
+// downloadTelegramFile downloads file uploaded by user
+func downloadTelegramFile(messenger Messenger, fileID string) ([]byte, error) {
+	url, err := messenger.GetFileDirectURL(fileID)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: importFetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, importFileLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > importFileLimit {
+		return nil, fmt.Errorf("file is too large")
+	}
+	return data, nil
+}
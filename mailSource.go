@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"net"
+	"time"
+)
+
+// idleRestartT is interval for re-issuing IDLE command before server drops idle connection (RFC 2177)
+const idleRestartT = 25 * time.Minute
+
+// imapTimeout limits connecting to IMAP server and every command except IDLE
+const imapTimeout = 2 * time.Minute
+
+// MailSource is connection to mail server. Email box handlers use it instead of IMAP client, so polling
+// and notifications can be tested with fake source and other protocols can be added.
+// Emails are identified by folder and UID, every method selects folder it works with.
+type MailSource interface {
+	Login(login, password string) error
+	Logout() error
+	// Connected returns false if connection was closed by server or by Logout
+	Connected() bool
+	ListFolders() ([]*imap.MailboxInfo, error)
+	// Status returns cursor pointing to last email in folder
+	Status(folder string) (MailboxCursor, error)
+	// FetchSince fetches emails with UID greater than lastUID. Emails fetched before error are returned with it.
+	FetchSince(folder string, lastUID uint32, items []imap.FetchItem) ([]*imap.Message, error)
+	// Fetch fetches emails by UID. Emails fetched before error are returned with it.
+	Fetch(folder string, uids []uint32, items []imap.FetchItem) ([]*imap.Message, error)
+	// FetchLast fetches count last emails of folder, all emails if count isn't positive
+	FetchLast(folder string, count int, items []imap.FetchItem) ([]*imap.Message, error)
+	AddFlags(folder string, uids []uint32, flags ...string) error
+	// SupportsUIDExpunge returns true if server can expunge single emails (UIDPLUS, RFC 4315)
+	SupportsUIDExpunge() bool
+	// Expunge permanently removes emails with given UIDs marked deleted, other deleted emails are kept
+	Expunge(folder string, uids []uint32) error
+	Move(folder string, uids []uint32, dest string) error
+}
+
+// IdleSource is MailSource which can wait for changes in folder without polling
+type IdleSource interface {
+	MailSource
+	SupportsIdle() bool
+	// Idle waits until folder changes or stop is closed
+	Idle(folder string, stop <-chan struct{}) error
+}
+
+// MailDialer connects to mail server
+type MailDialer interface {
+	Dial(host string) (MailSource, error)
+}
+
+// IMAPDialer is MailDialer connecting to IMAP servers over TLS. System root certificates are used if TLSConfig is nil.
+// Timeout limits connecting and every command except IDLE, zero means no timeout.
+type IMAPDialer struct {
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+}
+
+func (d IMAPDialer) Dial(host string) (MailSource, error) {
+	c, err := client.DialWithDialerTLS(&net.Dialer{Timeout: d.Timeout}, host, d.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	c.Timeout = d.Timeout
+	// Client waits until every update is read, so updates of command are handled when command is finished
+	updates := make(chan client.Update)
+	c.Updates = updates
+	src := &IMAPSource{c: c, changed: make(chan struct{}, 1), flush: make(chan chan struct{})}
+	go src.watchUpdates(updates)
+	return src, nil
+}
+
+// IMAPSource is MailSource implementation with go-imap client
+type IMAPSource struct {
+	c        *client.Client
+	changed  chan struct{}      //Signalled when mailbox is changed
+	flush    chan chan struct{} //Closes received channel when updates read before are handled
+	selected string
+	readOnly bool
+}
+
+// watchUpdates reads client updates for connection lifetime, because client is blocked until update is read.
+// Mailbox changes are collected from the start, so email received between fetch and IDLE isn't missed.
+// Changed flags and expunged emails are changes too, email waiting for acknowledgement could be read or moved.
+func (s *IMAPSource) watchUpdates(updates <-chan client.Update) {
+	for {
+		select {
+		case update := <-updates:
+			switch update.(type) {
+			case *client.MailboxUpdate, *client.MessageUpdate, *client.ExpungeUpdate:
+				select {
+				case s.changed <- struct{}{}:
+				default:
+				}
+			}
+		case done := <-s.flush:
+			close(done)
+		case <-s.c.LoggedOut():
+			return
+		}
+	}
+}
+
+// dropChanges drops changes received before. SELECT reports folder state as updates, they must not finish IDLE.
+func (s *IMAPSource) dropChanges() {
+	done := make(chan struct{})
+	select {
+	case s.flush <- done:
+		<-done
+	case <-s.c.LoggedOut():
+	}
+	select {
+	case <-s.changed:
+	default:
+	}
+}
+
+func (s *IMAPSource) Login(login, password string) error {
+	return s.c.Login(login, password)
+}
+
+func (s *IMAPSource) Logout() error {
+	return s.c.Logout()
+}
+
+func (s *IMAPSource) Connected() bool {
+	return s.c.State() != imap.LogoutState
+}
+
+func (s *IMAPSource) SupportsIdle() bool {
+	supportsIdle, err := s.c.Support("IDLE")
+	return err == nil && supportsIdle
+}
+
+func (s *IMAPSource) SupportsUIDExpunge() bool {
+	supportsUIDPlus, err := s.c.Support("UIDPLUS")
+	return err == nil && supportsUIDPlus
+}
+
+// selectFolder selects folder if it isn't selected yet. Emails are only read in folders opened read-only.
+func (s *IMAPSource) selectFolder(folder string, readOnly bool) error {
+	if s.selected == folder && s.readOnly == readOnly && s.c.Mailbox() != nil {
+		return nil
+	}
+	if _, err := s.c.Select(folder, readOnly); err != nil {
+		s.selected = ""
+		return err
+	}
+	s.selected, s.readOnly = folder, readOnly
+	return nil
+}
+
+func (s *IMAPSource) ListFolders() ([]*imap.MailboxInfo, error) {
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.c.List("", "*", mailboxes)
+	}()
+	folders := make([]*imap.MailboxInfo, 0)
+	for mailbox := range mailboxes {
+		folders = append(folders, mailbox)
+	}
+	return folders, <-done
+}
+
+// Status selects folder again, because UIDNEXT of selected folder isn't updated by server.
+// Changes received before are dropped, fresh status includes them.
+func (s *IMAPSource) Status(folder string) (MailboxCursor, error) {
+	mbox, err := s.c.Select(folder, true)
+	if err != nil {
+		s.selected = ""
+		return MailboxCursor{}, err
+	}
+	s.selected, s.readOnly = folder, true
+	s.dropChanges()
+	cursor := MailboxCursor{UIDValidity: mbox.UidValidity}
+	if mbox.UidNext != 0 {
+		cursor.LastUID = mbox.UidNext - 1
+		return cursor, nil
+	}
+	if mbox.Messages == 0 {
+		return cursor, nil
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(mbox.Messages)
+	messages, err := s.fetch(false, seqset, []imap.FetchItem{imap.FetchUid})
+	if err != nil {
+		return cursor, err
+	}
+	if len(messages) == 0 {
+		return cursor, fmt.Errorf("server returned no UID for last message")
+	}
+	cursor.LastUID = messages[0].Uid
+	return cursor, nil
+}
+
+func (s *IMAPSource) FetchSince(folder string, lastUID uint32, items []imap.FetchItem) ([]*imap.Message, error) {
+	if err := s.selectFolder(folder, true); err != nil {
+		return nil, err
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(lastUID+1, 0)
+	messages, err := s.fetch(true, seqset, items)
+	// UID range n:* always returns last message even if its UID is less than n
+	newMessages := make([]*imap.Message, 0, len(messages))
+	for _, msg := range messages {
+		if msg.Uid > lastUID {
+			newMessages = append(newMessages, msg)
+		}
+	}
+	return newMessages, err
+}
+
+func (s *IMAPSource) Fetch(folder string, uids []uint32, items []imap.FetchItem) ([]*imap.Message, error) {
+	if len(uids) == 0 {
+		return nil, nil
+	}
+	if err := s.selectFolder(folder, true); err != nil {
+		return nil, err
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	return s.fetch(true, seqset, items)
+}
+
+func (s *IMAPSource) FetchLast(folder string, count int, items []imap.FetchItem) ([]*imap.Message, error) {
+	if err := s.selectFolder(folder, true); err != nil {
+		return nil, err
+	}
+	total := s.c.Mailbox().Messages
+	if total == 0 {
+		return nil, nil
+	}
+	from := uint32(1)
+	if count > 0 && total > uint32(count) {
+		from = total - uint32(count) + 1
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(from, total)
+	return s.fetch(false, seqset, items)
+}
+
+func (s *IMAPSource) fetch(byUID bool, seqset *imap.SeqSet, items []imap.FetchItem) ([]*imap.Message, error) {
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		if byUID {
+			done <- s.c.UidFetch(seqset, items, messages)
+		} else {
+			done <- s.c.Fetch(seqset, items, messages)
+		}
+	}()
+	fetched := make([]*imap.Message, 0)
+	for msg := range messages {
+		fetched = append(fetched, msg)
+	}
+	return fetched, <-done
+}
+
+func (s *IMAPSource) AddFlags(folder string, uids []uint32, flags ...string) error {
+	if err := s.selectFolder(folder, false); err != nil {
+		return err
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	values := make([]interface{}, 0, len(flags))
+	for _, flag := range flags {
+		values = append(values, flag)
+	}
+	return s.c.UidStore(seqset, imap.FormatFlagsOp(imap.AddFlags, true), values, nil)
+}
+
+func (s *IMAPSource) Expunge(folder string, uids []uint32) error {
+	if err := s.selectFolder(folder, false); err != nil {
+		return err
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	return s.uidExpunge(seqset)
+}
+
+func (s *IMAPSource) uidExpunge(seqset *imap.SeqSet) error {
+	status, err := s.c.Execute(&uidExpungeCmd{seqset: seqset}, nil)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// uidExpungeCmd is UID EXPUNGE command of UIDPLUS extension, go-imap client doesn't implement it
+type uidExpungeCmd struct {
+	seqset *imap.SeqSet
+}
+
+func (cmd *uidExpungeCmd) Command() *imap.Command {
+	return &imap.Command{Name: "UID", Arguments: []interface{}{imap.RawString("EXPUNGE"), cmd.seqset}}
+}
+
+// Move uses MOVE command if server supports it. Otherwise emails are copied and marked deleted, they are expunged
+// only with UID EXPUNGE, because go-imap fallback expunges all deleted emails of folder.
+func (s *IMAPSource) Move(folder string, uids []uint32, dest string) error {
+	if err := s.selectFolder(folder, false); err != nil {
+		return err
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	if supportsMove, err := s.c.Support("MOVE"); err != nil || supportsMove {
+		return s.c.UidMove(seqset, dest)
+	}
+	if err := s.c.UidCopy(seqset, dest); err != nil {
+		return err
+	}
+	if err := s.c.UidStore(seqset, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil); err != nil {
+		return err
+	}
+	if !s.SupportsUIDExpunge() {
+		return nil
+	}
+	return s.uidExpunge(seqset)
+}
+
+// Idle waits for mailbox update with IMAP IDLE. IDLE command is re-issued every idleRestartT
+// to avoid server's 29 minutes inactivity logout. If folder isn't selected, state reported by SELECT
+// finishes IDLE at once, so folder is checked again.
+func (s *IMAPSource) Idle(folder string, stop <-chan struct{}) error {
+	if err := s.selectFolder(folder, true); err != nil {
+		return err
+	}
+	// Command timeout would drop waiting IDLE connection
+	timeout := s.c.Timeout
+	s.c.Timeout = 0
+	defer func() { s.c.Timeout = timeout }()
+	idleStop := make(chan struct{})
+	idleDone := make(chan error, 1)
+	go func() {
+		idleDone <- s.c.Idle(idleStop, &client.IdleOptions{LogoutTimeout: idleRestartT})
+	}()
+	for {
+		select {
+		case <-stop:
+			close(idleStop)
+			return <-idleDone
+		case err := <-idleDone:
+			if err == nil {
+				err = fmt.Errorf("idle finished unexpectedly")
+			}
+			return err
+		case <-s.changed:
+			close(idleStop)
+			return <-idleDone
+		}
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"fmt"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"log"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,6 +21,7 @@ changepatterns - Change patterns for email which to notify
 */
 
 var TGApiToken = flag.String("token", "", "Telegram API token")
+var DBPath = flag.String("db", "tgmailbot.db", "Path to database file with users, accounts and patterns")
 
 const (
 	AddAccount    = "Add account"
@@ -29,10 +32,23 @@ const (
 
 var knownServers = map[string]string{"@mail.ru": "imap.mail.ru:993"}
 
-var bot *tgbotapi.BotAPI
-
 type UserManager struct {
-	BotUsers map[int]*StoredUser
+	mu         sync.Mutex
+	BotUsers   map[int]*StoredUser
+	storage    Storage
+	messenger  Messenger
+	mailDialer MailDialer
+}
+
+// users returns snapshot of bot users for background workers
+func (mgr *UserManager) users() []*StoredUser {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	users := make([]*StoredUser, 0, len(mgr.BotUsers))
+	for _, user := range mgr.BotUsers {
+		users = append(users, user)
+	}
+	return users
 }
 
 type StoredEmailAccount struct {
@@ -42,6 +58,81 @@ type StoredEmailAccount struct {
 	password string
 	updateT  int
 	isActive bool
+	pushMode bool            //Wait for new emails with IMAP IDLE if server supports it
+	digest   *DigestSchedule //Notifications are sent in digest if set
+	// SMTP settings for replies. IMAP login and password are used if smtpLogin is empty.
+	smtpHost     string
+	smtpSecurity string
+	smtpLogin    string
+	smtpPassword string
+	// folders and cursors are shared with fetching worker, guarded by mu
+	mu      sync.Mutex
+	folders []string
+	cursors map[string]MailboxCursor
+}
+
+// MailboxCursor points to last seen message in mailbox. UIDs are valid only while UIDValidity doesn't change.
+type MailboxCursor struct {
+	UIDValidity uint32
+	LastUID     uint32
+}
+
+const defaultFolder = "INBOX"
+
+// monitoredFolders returns copy of folders list, INBOX if list is not set
+func (a *StoredEmailAccount) monitoredFolders() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.folders) == 0 {
+		return []string{defaultFolder}
+	}
+	return append([]string(nil), a.folders...)
+}
+
+// setFolders replaces monitored folders and drops cursors of folders which are not monitored anymore
+func (a *StoredEmailAccount) setFolders(folders []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.folders = folders
+	for folder := range a.cursors {
+		found := false
+		for _, f := range folders {
+			if f == folder {
+				found = true
+				break
+			}
+		}
+		if !found {
+			delete(a.cursors, folder)
+		}
+	}
+}
+
+func (a *StoredEmailAccount) folderCursor(folder string) (MailboxCursor, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cursor, ok := a.cursors[folder]
+	return cursor, ok
+}
+
+func (a *StoredEmailAccount) setFolderCursor(folder string, cursor MailboxCursor) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cursors == nil {
+		a.cursors = make(map[string]MailboxCursor)
+	}
+	a.cursors[folder] = cursor
+}
+
+// folderCursors returns copy of all folder cursors
+func (a *StoredEmailAccount) folderCursors() map[string]MailboxCursor {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cursors := make(map[string]MailboxCursor, len(a.cursors))
+	for folder, cursor := range a.cursors {
+		cursors[folder] = cursor
+	}
+	return cursors
 }
 
 //NotifyPatterns for filtering emails on which to send notifications
@@ -50,9 +141,17 @@ type NotifyPatterns struct {
 	FromEmail        string
 	FromPersonalName string
 	Subject          string
+	Conditions       []*PatternCondition //Conditions combined with AND. Legacy fields are used if empty
+	Exclude          bool                //Mute rule: matching emails are not notified even if other patterns match
+	AccountIDs       []int               //Accounts which pattern is applied to. Empty means all accounts
+	Digest           *DigestSchedule     //Matching emails are sent in digest. Nil means schedule of account
+	Priority         string
+	RequiresAck      bool //User is reminded about matching emails until acknowledges or reads them
 }
 
 type StoredUser struct {
+	// mu guards user's settings, accounts and patterns changed by dialogs from fetching workers
+	mu            sync.Mutex
 	ID            int
 	Login         string
 	ChatID        int64
@@ -62,6 +161,43 @@ type StoredUser struct {
 	dialogHandler    *UserDialogHandler
 	emailBoxHandlers []*EmailBoxHandler
 	Patterns         []*NotifyPatterns
+	storage          Storage
+	messenger        Messenger
+	mailDialer       MailDialer
+	notifications    sentNotifications
+	digests          digestQueue
+	acks             ackQueue
+	QuietHours       *QuietHours
+}
+
+// setServices sets messenger and mail dialer of user and all user's email box handlers
+func (u *StoredUser) setServices(messenger Messenger, mailDialer MailDialer) {
+	u.messenger = messenger
+	u.mailDialer = mailDialer
+	for _, boxHandler := range u.emailBoxHandlers {
+		boxHandler.messenger = messenger
+		boxHandler.mailDialer = mailDialer
+	}
+}
+
+// findEmailBoxHandler returns handler of user's account or nil if account is not found
+func (u *StoredUser) findEmailBoxHandler(accountID int) *EmailBoxHandler {
+	for _, boxHandler := range u.emailBoxHandlers {
+		if boxHandler.eAccount.id == accountID {
+			return boxHandler
+		}
+	}
+	return nil
+}
+
+// findEmailBoxHandlerByLogin returns handler of user's account with login. Host is not checked if empty.
+func (u *StoredUser) findEmailBoxHandlerByLogin(login string, imapHost string) *EmailBoxHandler {
+	for _, boxHandler := range u.emailBoxHandlers {
+		if boxHandler.eAccount.login == login && (imapHost == "" || boxHandler.eAccount.imapHost == imapHost) {
+			return boxHandler
+		}
+	}
+	return nil
 }
 
 type UserDialogHandler struct {
@@ -69,6 +205,12 @@ type UserDialogHandler struct {
 	lastSubCommand  string
 	chatID          int
 	newEmailAccount *StoredEmailAccount //Used if we adding new email account
+	folderChoices   []string            //Folders of selected account shown in folders picker
+	newPattern      *NotifyPatterns     //Used if we adding new pattern
+	newCondition    *PatternCondition   //Condition of new pattern which is being entered
+	conditionIndex  int                 //Index of condition of new pattern which is being entered or changed
+	editPatternID   int                 //ID of pattern which is being edited, 0 if new pattern is created
+	pendingImport   *userImport         //Validated import waiting for user's confirmation
 	commandFinished bool
 }
 
@@ -162,11 +304,17 @@ func (h *UserDialogHandler) AddEmailAccountHandler(inMsg *tgbotapi.Message, user
 
 	if h.newEmailAccount.password == "" {
 		delMsg := tgbotapi.NewDeleteMessage(user.ChatID, user.LastMessageId)
-		_, err := bot.DeleteMessage(delMsg)
+		_, err := user.messenger.DeleteMessage(delMsg)
 		if err != nil {
 			log.Println("Error deleting password message", err)
 		}
-		h.newEmailAccount.password = msg
+		sealedPassword, err := credentials.Seal(msg)
+		if err != nil {
+			log.Println("Error sealing password", err)
+			msgText := "Error saving password. Please enter password again:"
+			return h.makeTGMessage(msgText, user)
+		}
+		h.newEmailAccount.password = sealedPassword
 		msgText := fmt.Sprintf("Successfully added password.\nNow set update timeout in minutes:")
 		return h.makeTGMessage(msgText, user)
 	}
@@ -180,9 +328,11 @@ func (h *UserDialogHandler) AddEmailAccountHandler(inMsg *tgbotapi.Message, user
 		h.newEmailAccount.updateT = updTimeout
 		h.newEmailAccount.id = int(time.Now().Unix())
 		h.newEmailAccount.isActive = true
+		h.newEmailAccount.pushMode = true
 		boxHandler := NewEmailBoxHandler(h.newEmailAccount, user)
 		go boxHandler.StartFetchingEmails()
 		user.emailBoxHandlers = append(user.emailBoxHandlers, boxHandler)
+		user.Save()
 		msgText := fmt.Sprintf("Successfully added update timeout.\nAccount created" +
 			"\nDon't forget to use /changepatterns comamnd to setup email patterns")
 		h.commandFinished = true
@@ -246,11 +396,17 @@ func (h *UserDialogHandler) ChangeEmailAccountHandler(msg string, user *StoredUs
 		switch h.lastSubCommand {
 		case "chpwd":
 			delMsg := tgbotapi.NewDeleteMessage(user.ChatID, user.LastMessageId)
-			_, err := bot.DeleteMessage(delMsg)
+			_, err := user.messenger.DeleteMessage(delMsg)
 			if err != nil {
 				log.Println("Error deleting password message", err)
 			}
-			h.newEmailAccount.password = msg
+			sealedPassword, err := credentials.Seal(msg)
+			if err != nil {
+				log.Println("Error sealing password", err)
+				rMsgText = "Error saving password. Please enter password again:"
+				break
+			}
+			h.newEmailAccount.password = sealedPassword
 			rMsgText = "Password changed."
 			if h.newEmailAccount.isActive {
 				h.newEmailAccount.isActive = false
@@ -264,6 +420,36 @@ func (h *UserDialogHandler) ChangeEmailAccountHandler(msg string, user *StoredUs
 				rMsgText += " Don't forget to activate account."
 			}
 			h.lastSubCommand = ""
+		case "smtphost":
+			return h.SMTPHostEntered(msg, user)
+		case "chdigest":
+			schedule, err := ParseDigestSchedule(msg)
+			if err != nil {
+				rMsgText = "Wrong schedule: " + err.Error() + ". Please write it again"
+				break
+			}
+			h.newEmailAccount.digest = schedule
+			h.lastSubCommand = ""
+			rMsgText = fmt.Sprintf("Notifications of %s will be sent %s", h.newEmailAccount.login, schedule)
+		case "smtplogin":
+			h.newEmailAccount.smtpLogin = msg
+			h.lastSubCommand = "smtppwd"
+			rMsgText = "Now set SMTP password (message with password will be removed):"
+		case "smtppwd":
+			delMsg := tgbotapi.NewDeleteMessage(user.ChatID, user.LastMessageId)
+			_, err := user.messenger.DeleteMessage(delMsg)
+			if err != nil {
+				log.Println("Error deleting password message", err)
+			}
+			sealedPassword, err := credentials.Seal(msg)
+			if err != nil {
+				log.Println("Error sealing password", err)
+				rMsgText = "Error saving password. Please enter password again:"
+				break
+			}
+			h.newEmailAccount.smtpPassword = sealedPassword
+			h.lastSubCommand = ""
+			rMsgText = "SMTP settings saved. Reply to email notification to send answer."
 		case "chtmt":
 			nTimeout, err := strconv.Atoi(msg)
 			if err != nil {
@@ -286,6 +472,7 @@ func (h *UserDialogHandler) ChangeEmailAccountHandler(msg string, user *StoredUs
 		default:
 			rMsgText = "Something went wrong. Please try again."
 		}
+		user.Save()
 		rMsg := tgbotapi.NewMessage(user.ChatID, rMsgText)
 
 		return &rMsg, nil
@@ -322,11 +509,22 @@ func (h *UserDialogHandler) SelectEmailAccountCallback(accountID string, user *S
 		}
 		resultStr += fmt.Sprintf("Login: %s\n", h.newEmailAccount.login)
 		resultStr += fmt.Sprintf("IMAP host: %s\n", h.newEmailAccount.imapHost)
+		resultStr += fmt.Sprintf("Folders: %s\n", strings.Join(h.newEmailAccount.monitoredFolders(), ", "))
+		resultStr += fmt.Sprintf("Notifications: %s\n", h.newEmailAccount.digest)
+		if h.newEmailAccount.smtpHost != "" {
+			resultStr += fmt.Sprintf("SMTP host: %s (%s)\n", h.newEmailAccount.smtpHost, h.newEmailAccount.smtpSecurity)
+		} else {
+			resultStr += "SMTP is not configured\n"
+		}
 		changeTimeoutTest := fmt.Sprintf("Change timeout (now %d min)", h.newEmailAccount.updateT)
 		enableAccText := "Enable account"
 		if h.newEmailAccount.isActive {
 			enableAccText = "Disable account"
 		}
+		pushModeText := "Enable push (IDLE)"
+		if h.newEmailAccount.pushMode {
+			pushModeText = "Disable push (IDLE)"
+		}
 		pKeyboard := tgbotapi.NewInlineKeyboardMarkup(
 			tgbotapi.NewInlineKeyboardRow(
 				tgbotapi.NewInlineKeyboardButtonData("Change password", "chpwd"),
@@ -336,6 +534,14 @@ func (h *UserDialogHandler) SelectEmailAccountCallback(accountID string, user *S
 				tgbotapi.NewInlineKeyboardButtonData(enableAccText, "enabletrigger"),
 				tgbotapi.NewInlineKeyboardButtonData("Remove account", "rmacc"),
 			),
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData(pushModeText, "pushtrigger"),
+				tgbotapi.NewInlineKeyboardButtonData("Folders", "chfolders"),
+			),
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("SMTP settings", "chsmtp"),
+				tgbotapi.NewInlineKeyboardButtonData("Digest", "chdigest"),
+			),
 		)
 		rMsg := tgbotapi.NewMessage(user.ChatID, resultStr)
 		rMsg.ReplyMarkup = pKeyboard
@@ -358,6 +564,26 @@ func (h *UserDialogHandler) ChangeAccountCommandsH(inCommand string, user *Store
 	case "chtmt":
 		rMsgText = "Enter new timeout in minutes:"
 		h.lastSubCommand = "chtmt"
+	case "chsmtp":
+		rMsgText = "Enter SMTP host in format: <host>:<port>"
+		h.lastSubCommand = "smtphost"
+	case "chdigest":
+		rMsgText = fmt.Sprintf("Notifications are sent %s.\n%s", h.newEmailAccount.digest, digestScheduleHelp)
+		h.lastSubCommand = "chdigest"
+	case "smtps_" + smtpSecurityTLS, "smtps_" + smtpSecurityStartTLS:
+		h.newEmailAccount.smtpSecurity = strings.TrimPrefix(inCommand, "smtps_")
+		user.Save()
+		rMsg := tgbotapi.NewMessage(user.ChatID, "Does SMTP server use same login and password as IMAP?")
+		rMsg.ReplyMarkup = smtpCredentialsKeyboard()
+		return &rMsg, nil
+	case "smtpcred_same":
+		h.newEmailAccount.smtpLogin = ""
+		h.newEmailAccount.smtpPassword = ""
+		user.Save()
+		rMsgText = "SMTP settings saved. Reply to email notification to send answer."
+	case "smtpcred_other":
+		rMsgText = "Enter SMTP login:"
+		h.lastSubCommand = "smtplogin"
 	case "enabletrigger":
 		if h.newEmailAccount.isActive {
 			for _, boxHandler := range user.emailBoxHandlers {
@@ -377,6 +603,31 @@ func (h *UserDialogHandler) ChangeAccountCommandsH(inCommand string, user *Store
 			}
 			rMsgText = "Account enabled"
 		}
+		user.Save()
+	case "pushtrigger":
+		h.newEmailAccount.pushMode = !h.newEmailAccount.pushMode
+		if h.newEmailAccount.pushMode {
+			rMsgText = "Push mode enabled. New emails will be received with IMAP IDLE if server supports it."
+		} else {
+			rMsgText = fmt.Sprintf("Push mode disabled. Emails will be checked every %d min.", h.newEmailAccount.updateT)
+		}
+		if h.newEmailAccount.isActive {
+			for _, boxHandler := range user.emailBoxHandlers {
+				if boxHandler.eAccount == h.newEmailAccount {
+					boxHandler.Restart()
+					rMsgText += " Trying to reconnect."
+				}
+			}
+		}
+		user.Save()
+	case "chfolders":
+		for _, boxHandler := range user.emailBoxHandlers {
+			if boxHandler.eAccount == h.newEmailAccount {
+				go h.sendFoldersPicker(boxHandler, user)
+				return nil, nil
+			}
+		}
+		rMsgText = "We can't find selected account. Please choose from available"
 	case "rmacc":
 		var accId int
 		for id, emailBox := range user.emailBoxHandlers {
@@ -391,6 +642,7 @@ func (h *UserDialogHandler) ChangeAccountCommandsH(inCommand string, user *Store
 		copy(user.emailBoxHandlers[accId:], user.emailBoxHandlers[accId+1:])         // Shift a[i+1:] left one index.
 		user.emailBoxHandlers[len(user.emailBoxHandlers)-1] = nil                    // Erase last element (write zero value).
 		user.emailBoxHandlers = user.emailBoxHandlers[:len(user.emailBoxHandlers)-1] // Truncate slice.
+		user.Save()
 		rMsgText = "Account removed"
 	default:
 		rMsgText = "Please choose which parameter to change or select command from keyboard."
@@ -403,6 +655,87 @@ func (h *UserDialogHandler) ChangeAccountCommandsH(inCommand string, user *Store
 	return nil, nil
 }
 
+// sendFoldersPicker gets folders list from server in background and sends folders picker when it is received.
+// Picker isn't sent if user selected other account meanwhile.
+func (h *UserDialogHandler) sendFoldersPicker(boxHandler *EmailBoxHandler, user *StoredUser) {
+	folders, err := boxHandler.ListFolders()
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	var rMsg *tgbotapi.MessageConfig
+	if err != nil {
+		log.Println("Error listing folders", err)
+		errMsg := tgbotapi.NewMessage(user.ChatID, "Cannot get folders list from server: "+err.Error())
+		rMsg = &errMsg
+	} else if h.newEmailAccount == boxHandler.eAccount {
+		h.folderChoices = folders
+		rMsg = h.foldersPickerMessage(user)
+	} else {
+		return
+	}
+	if _, err := user.messenger.Send(*rMsg); err != nil {
+		log.Println("Error sending message to user. ", err)
+	}
+}
+
+func (h *UserDialogHandler) foldersPickerMessage(user *StoredUser) *tgbotapi.MessageConfig {
+	monitored := h.newEmailAccount.monitoredFolders()
+	folderRows := make([][]tgbotapi.InlineKeyboardButton, 0, len(h.folderChoices))
+	for i, folder := range h.folderChoices {
+		folderText := folder
+		for _, mFolder := range monitored {
+			if mFolder == folder {
+				folderText = "✅ " + folder
+				break
+			}
+		}
+		folderRows = append(folderRows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(folderText, "fld_"+strconv.Itoa(i))))
+	}
+	rMsgText := fmt.Sprintf("Monitored folders: %s\nSelect folder to add or remove", strings.Join(monitored, ", "))
+	rMsg := tgbotapi.NewMessage(user.ChatID, rMsgText)
+	if len(folderRows) > 0 {
+		rMsg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(folderRows...)
+	}
+	return &rMsg
+}
+
+// ToggleFolderCallback adds folder selected in folders picker to monitored folders or removes it
+func (h *UserDialogHandler) ToggleFolderCallback(data string, user *StoredUser) (*tgbotapi.MessageConfig, error) {
+	if h.newEmailAccount == nil {
+		return nil, fmt.Errorf("account not selected")
+	}
+	folderIdx, err := strconv.Atoi(strings.TrimPrefix(data, "fld_"))
+	if err != nil || folderIdx < 0 || folderIdx >= len(h.folderChoices) {
+		rMsg := tgbotapi.NewMessage(user.ChatID, "We can't find selected folder. Please choose from available")
+		return &rMsg, nil
+	}
+	folder := h.folderChoices[folderIdx]
+	monitored := h.newEmailAccount.monitoredFolders()
+	newFolders := make([]string, 0, len(monitored)+1)
+	for _, mFolder := range monitored {
+		if mFolder != folder {
+			newFolders = append(newFolders, mFolder)
+		}
+	}
+	if len(newFolders) == len(monitored) {
+		newFolders = append(newFolders, folder)
+	}
+	if len(newFolders) == 0 {
+		rMsg := tgbotapi.NewMessage(user.ChatID, "At least one folder must be monitored")
+		return &rMsg, nil
+	}
+	h.newEmailAccount.setFolders(newFolders)
+	if h.newEmailAccount.isActive {
+		for _, boxHandler := range user.emailBoxHandlers {
+			if boxHandler.eAccount == h.newEmailAccount {
+				boxHandler.Restart()
+			}
+		}
+	}
+	user.Save()
+	return h.foldersPickerMessage(user), nil
+}
+
 // ChangePatternsHandler handles changepatterns command
 func (h *UserDialogHandler) ChangePatternsHandler(msg string, user *StoredUser) (*tgbotapi.MessageConfig, error) {
 	h.lastSubCommand = ""
@@ -412,22 +745,14 @@ func (h *UserDialogHandler) ChangePatternsHandler(msg string, user *StoredUser)
 
 		patternButtons := make([][]tgbotapi.InlineKeyboardButton, 0, len(user.emailBoxHandlers))
 		for _, userPattern := range user.Patterns {
-			var patternStr string
-			if userPattern.Subject != "" {
-				patternStr = "Subject: " + userPattern.Subject
-			}
-			if userPattern.FromEmail != "" {
-				patternStr = "From email: " + userPattern.FromEmail
-			}
-			if userPattern.FromPersonalName != "" {
-				patternStr = "From person name: " + userPattern.FromPersonalName
-			}
+			patternStr := userPattern.String()
 			idStr := "pid_" + strconv.Itoa(userPattern.ID)
 			patternButtons = append(patternButtons, tgbotapi.NewInlineKeyboardRow(
 				tgbotapi.NewInlineKeyboardButtonData(patternStr, idStr)))
 		}
 		patternButtons = append(patternButtons, tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("Add new pattern", "newpattern")))
+			tgbotapi.NewInlineKeyboardButtonData("Add new pattern", "newpattern"),
+			tgbotapi.NewInlineKeyboardButtonData("Add mute rule", "newmute")))
 
 		pKeyboard := tgbotapi.NewInlineKeyboardMarkup(
 			patternButtons...,
@@ -452,24 +777,30 @@ func (h *UserDialogHandler) ShowPatternHandler(msg string, user *StoredUser) (*t
 	}
 	respStr := ""
 	delId := "did_" + patternIDStr
-	for _, uPattern := range user.Patterns {
-		if uPattern.ID == patternID {
-			if uPattern.Subject != "" {
-				respStr += "subject: " + uPattern.Subject
-			}
-			if uPattern.FromEmail != "" {
-				respStr += "email: " + uPattern.FromEmail
-			}
-			if uPattern.FromPersonalName != "" {
-				respStr += "person name: " + uPattern.FromPersonalName
-			}
+	var uPattern *NotifyPatterns
+	for _, userPattern := range user.Patterns {
+		if userPattern.ID == patternID {
+			uPattern = userPattern
+			respStr = uPattern.String()
 			break
 		}
 	}
 	if respStr != "" {
-		respStr = "Pattern for " + respStr
+		respStr = "Pattern: " + respStr + "\nAccounts: " + patternScopeText(uPattern, user)
+		if uPattern.Digest != nil {
+			respStr += "\nDelivery: " + uPattern.Digest.String()
+		}
+		if uPattern.Priority != priorityNormal {
+			respStr += "\nPriority: " + priorityNames[uPattern.Priority]
+		}
+		if uPattern.RequiresAck {
+			respStr += "\nRequires acknowledgement"
+		}
 		pKeyboard := tgbotapi.NewInlineKeyboardMarkup(
-			tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("Delete", delId)),
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("Edit", "eid_"+patternIDStr),
+				tgbotapi.NewInlineKeyboardButtonData("Delete", delId),
+			),
 		)
 		rMsg := tgbotapi.NewMessage(user.ChatID, respStr)
 		rMsg.ReplyMarkup = pKeyboard
@@ -501,22 +832,50 @@ func (h *UserDialogHandler) DeletePatternHandler(msg string, user *StoredUser) (
 	copy(user.Patterns[indexToDelete:], user.Patterns[indexToDelete+1:]) // Shift a[i+1:] left one index.
 	user.Patterns[len(user.Patterns)-1] = nil                            // Erase last element (write zero value).
 	user.Patterns = user.Patterns[:len(user.Patterns)-1]                 // Truncate slice.
+	user.Save()
 	rMsg := tgbotapi.NewMessage(user.ChatID, "Pattern removed")
 	h.commandFinished = true
 	return &rMsg, nil
 }
 
+// NewPatternHandler creates pattern step by step: field, match mode and text of every condition.
+// Conditions of one pattern are combined with AND, different patterns are combined with OR.
 func (h *UserDialogHandler) NewPatternHandler(msg string, user *StoredUser) (*tgbotapi.MessageConfig, error) {
-	commands := map[string]string{
-		"nsbj":        "Subject",
-		"semail":      "Source email",
-		"spersonname": "Source person name",
+	commands := []struct {
+		cmd   string
+		text  string
+		field string
+	}{
+		{"nsbj", "Subject", patternFieldSubject},
+		{"semail", "Source email", patternFieldFromEmail},
+		{"spersonname", "Source person name", patternFieldFromName},
+		{"sdomain", "Source domain", patternFieldFromDomain},
+		{"slistid", "Mailing list (List-Id)", patternFieldListID},
+		{"sto", "Recipient (To)", patternFieldTo},
+		{"scc", "Copy recipient (Cc)", patternFieldCc},
+		{"sheader", "Other header", patternFieldHeader},
+		{"sbody", "Body text", patternFieldBody},
 	}
-	if msg == "newpattern" {
+	if msg == "newpattern" || msg == "newmute" || msg == "pcond_add" || strings.HasPrefix(msg, "pedc_") {
+		if msg == "newpattern" || msg == "newmute" || h.newPattern == nil {
+			h.newPattern = &NotifyPatterns{ID: int(time.Now().Unix()), Exclude: msg == "newmute"}
+			h.editPatternID = 0
+		}
+		h.conditionIndex = len(h.newPattern.Conditions)
+		if strings.HasPrefix(msg, "pedc_") {
+			index, err := strconv.Atoi(strings.TrimPrefix(msg, "pedc_"))
+			if err != nil || index < 0 || index >= len(h.newPattern.Conditions) {
+				return nil, fmt.Errorf("wrong condition to edit: %s", msg)
+			}
+			h.conditionIndex = index
+		}
 		rMsgText := "Choose for which field in email add pattern"
+		if h.newPattern.Exclude {
+			rMsgText = "Choose which email field the mute rule checks"
+		}
 		inlineRows := make([][]tgbotapi.InlineKeyboardButton, 0, len(commands))
-		for cmd, text := range commands {
-			newRow := tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(text, cmd))
+		for _, command := range commands {
+			newRow := tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(command.text, command.cmd))
 			inlineRows = append(inlineRows, newRow)
 		}
 		pKeyboard := tgbotapi.NewInlineKeyboardMarkup(inlineRows...)
@@ -525,35 +884,313 @@ func (h *UserDialogHandler) NewPatternHandler(msg string, user *StoredUser) (*tg
 		h.lastSubCommand = "npch"
 		return &rMsg, nil
 	}
-	typeText, ok := commands[msg]
-	if ok {
-		h.lastSubCommand = msg
-		rMsgText := fmt.Sprintf("Please write pattern text for %s. We find keyword as substring in email fields.",
-			strings.ToLower(typeText))
-		rMsg := tgbotapi.NewMessage(user.ChatID, rMsgText)
+	if h.newPattern == nil {
+		h.lastSubCommand = ""
+		rMsg := tgbotapi.NewMessage(user.ChatID, "Please start adding pattern again")
+		h.commandFinished = true
 		return &rMsg, nil
-	} else {
-		newPattern := &NotifyPatterns{ID: int(time.Now().Unix())}
-		newVal := strings.ToLower(msg)
-		switch h.lastSubCommand {
-		case "nsbj":
-			newPattern.Subject = newVal
-		case "semail":
-			if !strings.Contains(newVal, "@") {
-				rMsg := tgbotapi.NewMessage(user.ChatID, "Email address is not valid")
+	}
+
+	switch h.lastSubCommand {
+	case "npch":
+		for _, command := range commands {
+			if command.cmd != msg {
+				continue
+			}
+			h.newCondition = &PatternCondition{Field: command.field}
+			if command.field == patternFieldHeader {
+				h.lastSubCommand = "npheader"
+				rMsg := tgbotapi.NewMessage(user.ChatID, "Please write header name, for example X-Priority")
 				return &rMsg, nil
 			}
-			newPattern.FromEmail = newVal
-		case "spersonname":
-			newPattern.FromPersonalName = newVal
+			h.lastSubCommand = "npmode"
+			return h.patternModeMessage(strings.ToLower(command.text), user), nil
 		}
-		user.Patterns = append(user.Patterns, newPattern)
-		rMsgText := "New pattern saved"
-		h.lastSubCommand = ""
-		rMsg := tgbotapi.NewMessage(user.ChatID, rMsgText)
-		h.commandFinished = true
-		return &rMsg, nil
+	case "npheader":
+		header := strings.TrimSpace(msg)
+		if !headerNameRegexp.MatchString(header) {
+			rMsg := tgbotapi.NewMessage(user.ChatID, "Header name is not valid. Please write it again")
+			return &rMsg, nil
+		}
+		h.newCondition.Header = header
+		h.lastSubCommand = "npmode"
+		return h.patternModeMessage("header "+header, user), nil
+	case "npmode":
+		mode := strings.TrimPrefix(msg, "pm_")
+		if mode == matchContains || mode == matchEquals || mode == matchRegex || mode == matchGlob ||
+			(mode == matchDomain && addressFields[h.newCondition.Field]) {
+			h.newCondition.Mode = mode
+			h.lastSubCommand = "npval"
+			fieldText := patternFieldNames[h.newCondition.Field]
+			if h.newCondition.Field == patternFieldHeader {
+				fieldText += " " + h.newCondition.Header
+			}
+			rMsgText := fmt.Sprintf("Please write pattern text for %s.", fieldText)
+			switch mode {
+			case matchRegex:
+				rMsgText = fmt.Sprintf("Please write regular expression for %s.", fieldText)
+			case matchGlob:
+				rMsgText = fmt.Sprintf("Please write pattern for %s. Use * for any characters and ? for one character,"+
+					" for example *@*.example.com", fieldText)
+			case matchDomain:
+				rMsgText = fmt.Sprintf("Please write domain for %s, for example example.com. Subdomains also match.", fieldText)
+			}
+			rMsg := tgbotapi.NewMessage(user.ChatID, rMsgText)
+			return &rMsg, nil
+		}
+	case "npval":
+		condition := h.newCondition
+		condition.Value = msg
+		if addressFields[condition.Field] {
+			condition.Value = strings.TrimSpace(msg)
+			if condition.Mode == matchDomain || condition.Field == patternFieldFromDomain {
+				condition.Value = strings.TrimPrefix(condition.Value, "@")
+			}
+		}
+		if err := condition.Compile(); err != nil {
+			rMsg := tgbotapi.NewMessage(user.ChatID, "Pattern is not valid: "+err.Error()+"\nPlease write it again")
+			return &rMsg, nil
+		}
+		if h.conditionIndex < len(h.newPattern.Conditions) {
+			h.newPattern.Conditions[h.conditionIndex] = condition
+		} else {
+			h.newPattern.Conditions = append(h.newPattern.Conditions, condition)
+			h.conditionIndex = len(h.newPattern.Conditions) - 1
+		}
+		h.newCondition = nil
+		h.lastSubCommand = "npconfirm"
+		return h.newPatternConfirmMessage(user), nil
+	case "npconfirm":
+		switch msg {
+		case "pcase":
+			if h.conditionIndex < 0 || h.conditionIndex >= len(h.newPattern.Conditions) {
+				return h.newPatternConfirmMessage(user), nil
+			}
+			condition := h.newPattern.Conditions[h.conditionIndex]
+			condition.CaseSensitive = !condition.CaseSensitive
+			if err := condition.Compile(); err != nil {
+				return nil, err
+			}
+			return h.newPatternConfirmMessage(user), nil
+		case "pscope":
+			h.lastSubCommand = "npscope"
+			return h.patternScopeMessage(user), nil
+		case "ptest":
+			return h.TestPatternHandler(user)
+		case "pprio":
+			switch h.newPattern.Priority {
+			case priorityLow:
+				h.newPattern.Priority = priorityNormal
+			case priorityNormal:
+				h.newPattern.Priority = priorityUrgent
+			default:
+				h.newPattern.Priority = priorityLow
+			}
+			return h.newPatternConfirmMessage(user), nil
+		case "pack":
+			h.newPattern.RequiresAck = !h.newPattern.RequiresAck
+			return h.newPatternConfirmMessage(user), nil
+		case "pdigest":
+			h.lastSubCommand = "npdigest"
+			rMsg := tgbotapi.NewMessage(user.ChatID, "Write when to send emails matching pattern. "+
+				digestScheduleHelp+"\nWrite \"off\" to use schedule of account.")
+			return &rMsg, nil
+		case "psave":
+			if len(h.newPattern.Conditions) == 0 {
+				return h.newPatternConfirmMessage(user), nil
+			}
+			rMsgText := "New pattern saved"
+			if h.newPattern.Exclude {
+				rMsgText = "Mute rule saved"
+			}
+			if h.editPatternID != 0 {
+				rMsgText = "Pattern not found, it could be removed"
+				for _, uPattern := range user.Patterns {
+					if uPattern.ID == h.editPatternID {
+						uPattern.applyEdit(h.newPattern)
+						rMsgText = "Pattern updated"
+						break
+					}
+				}
+				h.editPatternID = 0
+			} else {
+				user.Patterns = append(user.Patterns, h.newPattern)
+			}
+			user.Save()
+			h.lastSubCommand = ""
+			rMsg := tgbotapi.NewMessage(user.ChatID, rMsgText)
+			h.newPattern = nil
+			h.commandFinished = true
+			return &rMsg, nil
+		}
+	case "npdigest":
+		schedule, err := ParseDigestSchedule(msg)
+		if err != nil {
+			rMsg := tgbotapi.NewMessage(user.ChatID, "Wrong schedule: "+err.Error()+". Please write it again")
+			return &rMsg, nil
+		}
+		h.newPattern.Digest = schedule
+		h.lastSubCommand = "npconfirm"
+		return h.newPatternConfirmMessage(user), nil
+	case "npscope":
+		if msg == "pscope_done" {
+			h.lastSubCommand = "npconfirm"
+			return h.newPatternConfirmMessage(user), nil
+		}
+		if msg == "psacc_all" {
+			h.newPattern.AccountIDs = nil
+			return h.patternScopeMessage(user), nil
+		}
+		if strings.HasPrefix(msg, "psacc_") {
+			accountID, err := strconv.Atoi(strings.TrimPrefix(msg, "psacc_"))
+			if err != nil {
+				return nil, err
+			}
+			h.newPattern.toggleAccount(accountID)
+			return h.patternScopeMessage(user), nil
+		}
+	}
+	rMsg := tgbotapi.NewMessage(user.ChatID, "Please choose option with buttons above")
+	return &rMsg, nil
+}
+
+// patternModeMessage asks how to compare field of new condition with pattern text
+func (h *UserDialogHandler) patternModeMessage(fieldText string, user *StoredUser) *tgbotapi.MessageConfig {
+	rows := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Contains", "pm_"+matchContains),
+			tgbotapi.NewInlineKeyboardButtonData("Equals", "pm_"+matchEquals),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Regular expression", "pm_"+matchRegex),
+			tgbotapi.NewInlineKeyboardButtonData("Wildcard (*, ?)", "pm_"+matchGlob),
+		),
+	}
+	if addressFields[h.newCondition.Field] {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Domain and subdomains", "pm_"+matchDomain)))
+	}
+	rMsg := tgbotapi.NewMessage(user.ChatID, "Choose how to match "+fieldText)
+	rMsg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return &rMsg
+}
+
+// newPatternConfirmMessage shows conditions of new pattern and asks to add one more condition or save pattern
+func (h *UserDialogHandler) newPatternConfirmMessage(user *StoredUser) *tgbotapi.MessageConfig {
+	rows := make([][]tgbotapi.InlineKeyboardButton, 0, len(h.newPattern.Conditions)+3)
+	rMsgText := "New pattern: " + h.newPattern.String() + "\n"
+	if h.newPattern.Exclude {
+		rMsgText = "New mute rule: " + h.newPattern.String() + "\n"
+	}
+	if h.editPatternID != 0 {
+		rMsgText = "Edit pattern: " + h.newPattern.String() + "\n"
+		rMsgText += "Choose condition to change, add another condition or save pattern"
+		for i, condition := range h.newPattern.Conditions {
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("Change "+condition.String(), "pedc_"+strconv.Itoa(i))))
+		}
+	} else {
+		rMsgText += "Add another condition which also must match or save pattern"
+	}
+	optionsRow := tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("Add AND condition", "pcond_add"))
+	if h.conditionIndex >= 0 && h.conditionIndex < len(h.newPattern.Conditions) {
+		caseText := "Case sensitive: off"
+		if h.newPattern.Conditions[h.conditionIndex].CaseSensitive {
+			caseText = "Case sensitive: on"
+		}
+		optionsRow = append(optionsRow, tgbotapi.NewInlineKeyboardButtonData(caseText, "pcase"))
+	}
+	rows = append(rows,
+		optionsRow,
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Accounts: "+patternScopeText(h.newPattern, user), "pscope"),
+		),
+	)
+	if !h.newPattern.Exclude {
+		digestText := "Delivery: account schedule"
+		if h.newPattern.Digest != nil {
+			digestText = "Delivery: " + h.newPattern.Digest.String()
+		}
+		ackText := "Requires ack: off"
+		if h.newPattern.RequiresAck {
+			ackText = "Requires ack: on"
+		}
+		rows = append(rows,
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData(digestText, "pdigest"),
+				tgbotapi.NewInlineKeyboardButtonData("Priority: "+priorityNames[h.newPattern.Priority], "pprio"),
+			),
+			tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(ackText, "pack")),
+		)
+	}
+	rows = append(rows,
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Test pattern", "ptest"),
+			tgbotapi.NewInlineKeyboardButtonData("Save", "psave"),
+		),
+	)
+	rMsg := tgbotapi.NewMessage(user.ChatID, rMsgText)
+	rMsg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return &rMsg
+}
+
+// EditPatternHandler starts editing of existing pattern. Pattern is changed in place when user saves it,
+// so its ID is preserved.
+func (h *UserDialogHandler) EditPatternHandler(msg string, user *StoredUser) (*tgbotapi.MessageConfig, error) {
+	patternID, err := strconv.Atoi(strings.TrimPrefix(msg, "eid_"))
+	if err != nil {
+		nMsg := tgbotapi.NewMessage(user.ChatID, "Error selecting pattern")
+		return &nMsg, nil
+	}
+	for _, uPattern := range user.Patterns {
+		if uPattern.ID == patternID {
+			h.newPattern = uPattern.editCopy()
+			h.editPatternID = patternID
+			h.conditionIndex = len(h.newPattern.Conditions) - 1
+			h.lastSubCommand = "npconfirm"
+			return h.newPatternConfirmMessage(user), nil
+		}
+	}
+	rMsg := tgbotapi.NewMessage(user.ChatID, "Cannot find pattern")
+	return &rMsg, nil
+}
+
+// patternScopeMessage shows accounts picker for new pattern. Selected accounts are marked with check mark.
+func (h *UserDialogHandler) patternScopeMessage(user *StoredUser) *tgbotapi.MessageConfig {
+	rows := make([][]tgbotapi.InlineKeyboardButton, 0, len(user.emailBoxHandlers)+2)
+	allText := "All accounts"
+	if len(h.newPattern.AccountIDs) == 0 {
+		allText = "✅ " + allText
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(allText, "psacc_all")))
+	for _, boxHandler := range user.emailBoxHandlers {
+		accountText := boxHandler.eAccount.login
+		if h.newPattern.hasAccount(boxHandler.eAccount.id) {
+			accountText = "✅ " + accountText
+		}
+		idStr := "psacc_" + strconv.Itoa(boxHandler.eAccount.id)
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(accountText, idStr)))
 	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("Done", "pscope_done")))
+	rMsg := tgbotapi.NewMessage(user.ChatID, "Choose accounts which pattern is applied to")
+	rMsg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return &rMsg
+}
+
+// patternScopeText returns logins of accounts which pattern is applied to
+func patternScopeText(pattern *NotifyPatterns, user *StoredUser) string {
+	if len(pattern.AccountIDs) == 0 {
+		return "all"
+	}
+	logins := make([]string, 0, len(pattern.AccountIDs))
+	for _, accountID := range pattern.AccountIDs {
+		login := "removed account"
+		if boxHandler := user.findEmailBoxHandler(accountID); boxHandler != nil {
+			login = boxHandler.eAccount.login
+		}
+		logins = append(logins, login)
+	}
+	return strings.Join(logins, ", ")
 }
 
 func (h *UserDialogHandler) SetInitialKeyboard(chatID int64) *tgbotapi.MessageConfig {
@@ -572,6 +1209,9 @@ func (h *UserDialogHandler) SetInitialKeyboard(chatID int64) *tgbotapi.MessageCo
 	msgText += "/listaccounts - List existing mail accounts\n"
 	msgText += "/changeaccount - Change account settings (password/refresh timeout) or remove account\n"
 	msgText += "/changepatterns - Change patterns for email which to notify\n"
+	msgText += "/export - Export accounts and patterns to YAML file (/export json for JSON)\n"
+	msgText += "/import - Import accounts settings and patterns from file\n"
+	msgText += "/quiethours - Set hours when notifications are delayed or sent without sound\n"
 	rMsg := tgbotapi.NewMessage(chatID, msgText)
 	rMsg.ReplyMarkup = pKeyboard
 	return &rMsg
@@ -579,10 +1219,17 @@ func (h *UserDialogHandler) SetInitialKeyboard(chatID int64) *tgbotapi.MessageCo
 
 func (h *UserDialogHandler) CleanTempStores() {
 	h.newEmailAccount = nil
+	h.folderChoices = nil
+	h.newPattern = nil
+	h.newCondition = nil
+	h.editPatternID = 0
+	h.pendingImport = nil
 	h.lastSubCommand = ""
 }
 
 func (mgr *UserManager) CheckUser(user *tgbotapi.User, chatID int64) *StoredUser {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
 	userProfile, ok := mgr.BotUsers[user.ID]
 	if !ok {
 		newUser := &StoredUser{
@@ -593,191 +1240,322 @@ func (mgr *UserManager) CheckUser(user *tgbotapi.User, chatID int64) *StoredUser
 			dialogHandler:    &UserDialogHandler{},
 			emailBoxHandlers: make([]*EmailBoxHandler, 0),
 			Patterns:         make([]*NotifyPatterns, 0),
+			storage:          mgr.storage,
+			messenger:        mgr.messenger,
+			mailDialer:       mgr.mailDialer,
 		}
 		mgr.BotUsers[user.ID] = newUser
+		newUser.Save()
 		return newUser
 	}
-	userProfile.ChatID = chatID
+	if userProfile.ChatID != chatID {
+		userProfile.mu.Lock()
+		userProfile.ChatID = chatID
+		userProfile.Save()
+		userProfile.mu.Unlock()
+	}
 	return userProfile
 }
 
+// LoadUsers restores users from storage and starts email box handlers for active accounts
+func (mgr *UserManager) LoadUsers() error {
+	users, err := mgr.storage.LoadUsers()
+	if err != nil {
+		return err
+	}
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	for _, user := range users {
+		user.setServices(mgr.messenger, mgr.mailDialer)
+		mgr.BotUsers[user.ID] = user
+		for _, boxHandler := range user.emailBoxHandlers {
+			if boxHandler.eAccount.isActive {
+				go boxHandler.StartFetchingEmails()
+			}
+		}
+	}
+	log.Printf("Loaded %d users from storage", len(users))
+	return nil
+}
+
 func main() {
 
 	flag.Parse()
 	var err error
+	masterKey := *MasterKey
+	if masterKey == "" {
+		masterKey = os.Getenv(masterKeyEnv)
+	}
+	credentials, err = NewCredentialCipher(masterKey)
+	if err != nil {
+		log.Println("Master key is required.", err)
+		return
+	}
+	if flag.Arg(0) == "rotatekey" {
+		runRotateKeyCommand(flag.Args()[1:])
+		return
+	}
+
 	if *TGApiToken == "" {
 		log.Println("Api token is required")
 		return
 	}
 
-	bot, err = tgbotapi.NewBotAPI(*TGApiToken)
+	botAPI, err := tgbotapi.NewBotAPI(*TGApiToken)
 	if err != nil {
 		log.Panic(err)
 	}
+	messenger := NewTelegramMessenger(botAPI)
 
-	botUsersManager := &UserManager{BotUsers: map[int]*StoredUser{}}
+	storage, err := NewBoltStorage(*DBPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer storage.Close()
+
+	botUsersManager := &UserManager{BotUsers: map[int]*StoredUser{}, storage: storage, messenger: messenger, mailDialer: IMAPDialer{Timeout: imapTimeout}}
+	if err := botUsersManager.LoadUsers(); err != nil {
+		log.Panic(err)
+	}
 
-	log.Printf("Authorized on account %s", bot.Self.UserName)
+	log.Printf("Authorized on account %s", botAPI.Self.UserName)
 
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 10
 
-	updates, err := bot.GetUpdatesChan(u)
+	updates, err := botAPI.GetUpdatesChan(u)
 
-	for update := range updates {
-		if update.Message == nil && update.CallbackQuery == nil { // ignore any non-Message Updates
-			continue
+	scheduleTicker := time.NewTicker(digestCheckT)
+	defer scheduleTicker.Stop()
+	for {
+		select {
+		case update := <-updates:
+			botUsersManager.HandleUpdate(update)
+		case now := <-scheduleTicker.C:
+			botUsersManager.SendScheduledNotifications(now)
 		}
-		var msg *tgbotapi.MessageConfig
-
-		if update.CallbackQuery != nil {
-			inCallback := update.CallbackQuery
-			_, err := bot.AnswerCallbackQuery(tgbotapi.NewCallback(update.CallbackQuery.ID, update.CallbackQuery.Data))
-			if err != nil {
-				log.Println("Error making callback query ", err)
-			}
-			userProfile := botUsersManager.CheckUser(inCallback.From, inCallback.Message.Chat.ID)
+	}
+}
 
-			switch userProfile.dialogHandler.lastCommand {
-			case "/changeaccount":
-				var rMsg *tgbotapi.MessageConfig
-				var err error
-				if strings.HasPrefix(inCallback.Data, "id_") {
-					rMsg, err = userProfile.dialogHandler.SelectEmailAccountCallback(inCallback.Data, userProfile)
-				} else {
-					rMsg, err = userProfile.dialogHandler.ChangeAccountCommandsH(inCallback.Data, userProfile)
-					if err != nil {
-						rMsg, err = userProfile.dialogHandler.ChangeEmailAccountHandler(ChangeAccount, userProfile)
-					}
-				}
+// HandleUpdate handles message or callback query received from Telegram
+func (mgr *UserManager) HandleUpdate(update tgbotapi.Update) {
+	var err error
+	if update.Message == nil && update.CallbackQuery == nil { // ignore any non-Message Updates
+		return
+	}
+	var msg *tgbotapi.MessageConfig
 
-				if err != nil {
-					log.Println("Error listing accounts")
-					continue
-				} else {
-					if rMsg != nil {
-						msg = rMsg
-					}
-				}
+	if update.CallbackQuery != nil {
+		inCallback := update.CallbackQuery
+		_, err := mgr.messenger.AnswerCallbackQuery(tgbotapi.NewCallback(update.CallbackQuery.ID, update.CallbackQuery.Data))
+		if err != nil {
+			log.Println("Error making callback query ", err)
+		}
+		userProfile := mgr.CheckUser(inCallback.From, inCallback.Message.Chat.ID)
+		userProfile.mu.Lock()
+		defer userProfile.mu.Unlock()
 
-			case "/changepatterns":
-				var rMsg *tgbotapi.MessageConfig
-				var err error
-				if strings.HasPrefix(inCallback.Data, "pid_") {
-					rMsg, err = userProfile.dialogHandler.ShowPatternHandler(inCallback.Data, userProfile)
-				}
-				if strings.HasPrefix(inCallback.Data, "did_") {
-					rMsg, err = userProfile.dialogHandler.DeletePatternHandler(inCallback.Data, userProfile)
-				}
-				if inCallback.Data == "newpattern" {
-					rMsg, err = userProfile.dialogHandler.NewPatternHandler(inCallback.Data, userProfile)
-				}
-				if userProfile.dialogHandler.lastSubCommand != "" {
-					rMsg, err = userProfile.dialogHandler.NewPatternHandler(inCallback.Data, userProfile)
-				}
-				if err != nil {
-					continue
-				} else {
-					if rMsg != nil {
-						msg = rMsg
-					}
-				}
-			default:
-				msg = userProfile.dialogHandler.SetInitialKeyboard(userProfile.ChatID)
+		if strings.HasPrefix(inCallback.Data, emailActionPrefix) {
+			msg, err = userProfile.dialogHandler.EmailActionCallback(inCallback.Data, userProfile)
+			if err != nil {
+				log.Println("Error running email action", err)
 			}
 			if msg != nil {
-				_, err := bot.Send(*msg)
+				_, err := mgr.messenger.Send(*msg)
 				if err != nil {
 					log.Println("Error sending message to user")
 				}
 			}
-
+			return
 		}
-		if update.Message != nil {
-			inMsg := update.Message
 
-			userProfile := botUsersManager.CheckUser(update.Message.From, inMsg.Chat.ID)
-			userProfile.LastMessageId = inMsg.MessageID
+		switch userProfile.dialogHandler.lastCommand {
+		case "/changeaccount":
+			var rMsg *tgbotapi.MessageConfig
+			var err error
+			if strings.HasPrefix(inCallback.Data, "id_") {
+				rMsg, err = userProfile.dialogHandler.SelectEmailAccountCallback(inCallback.Data, userProfile)
+			} else if strings.HasPrefix(inCallback.Data, "fld_") {
+				rMsg, err = userProfile.dialogHandler.ToggleFolderCallback(inCallback.Data, userProfile)
+				if err != nil {
+					rMsg, err = userProfile.dialogHandler.ChangeEmailAccountHandler(ChangeAccount, userProfile)
+				}
+			} else {
+				rMsg, err = userProfile.dialogHandler.ChangeAccountCommandsH(inCallback.Data, userProfile)
+				if err != nil {
+					rMsg, err = userProfile.dialogHandler.ChangeEmailAccountHandler(ChangeAccount, userProfile)
+				}
+			}
 
-			inMsgText := update.Message.Text
+			if err != nil {
+				log.Println("Error listing accounts")
+				return
+			} else {
+				if rMsg != nil {
+					msg = rMsg
+				}
+			}
 
-			currentCommand := ""
-			if strings.HasPrefix(inMsgText, "/") {
-				currentCommand = inMsgText
-				userProfile.dialogHandler.CleanTempStores()
+		case "/changepatterns":
+			var rMsg *tgbotapi.MessageConfig
+			var err error
+			if strings.HasPrefix(inCallback.Data, "pid_") {
+				rMsg, err = userProfile.dialogHandler.ShowPatternHandler(inCallback.Data, userProfile)
+			} else if strings.HasPrefix(inCallback.Data, "did_") {
+				rMsg, err = userProfile.dialogHandler.DeletePatternHandler(inCallback.Data, userProfile)
+			} else if strings.HasPrefix(inCallback.Data, "eid_") {
+				rMsg, err = userProfile.dialogHandler.EditPatternHandler(inCallback.Data, userProfile)
+			} else if inCallback.Data == "newpattern" || inCallback.Data == "newmute" ||
+				userProfile.dialogHandler.lastSubCommand != "" {
+				rMsg, err = userProfile.dialogHandler.NewPatternHandler(inCallback.Data, userProfile)
+			}
+			if err != nil {
+				return
 			} else {
-				switch inMsgText {
-				case AddAccount:
-					currentCommand = "/addaccount"
-				case ListAccounts:
-					currentCommand = "/listaccounts"
-				case ChangeAccount:
-					currentCommand = "/changeaccount"
-				case ChangePattern:
-					currentCommand = "/changepatterns"
-				default:
-					currentCommand = userProfile.dialogHandler.lastCommand
+				if rMsg != nil {
+					msg = rMsg
 				}
 			}
+		case "/import":
+			msg, err = userProfile.dialogHandler.ImportCallback(inCallback.Data, userProfile)
+			if err != nil {
+				return
+			}
+		default:
+			msg = userProfile.dialogHandler.SetInitialKeyboard(userProfile.ChatID)
+		}
+		if msg != nil {
+			_, err := mgr.messenger.Send(*msg)
+			if err != nil {
+				log.Println("Error sending message to user")
+			}
+		}
 
-			switch currentCommand {
-			case "/start":
-				msg = userProfile.dialogHandler.SetInitialKeyboard(userProfile.ChatID)
-			case "/addaccount":
-				msg, err = userProfile.dialogHandler.AddEmailAccountHandler(inMsg, userProfile)
+	}
+	if update.Message != nil {
+		inMsg := update.Message
 
-				if err != nil {
-					log.Println("Error creating account")
-					continue
-				}
+		userProfile := mgr.CheckUser(update.Message.From, inMsg.Chat.ID)
+		userProfile.mu.Lock()
+		defer userProfile.mu.Unlock()
+		userProfile.LastMessageId = inMsg.MessageID
 
-			case "/listaccounts":
-				msg, err = userProfile.dialogHandler.ListAccountsHandler(userProfile)
-				if err != nil {
-					log.Println("Error listing account")
-					continue
-				}
-			case "/changeaccount":
-				msg, err = userProfile.dialogHandler.ChangeEmailAccountHandler(inMsgText, userProfile)
+		inMsgText := update.Message.Text
+
+		if inMsg.ReplyToMessage != nil {
+			ref, ok := userProfile.notifications.get(inMsg.ReplyToMessage.MessageID)
+			if ok {
+				msg, err = userProfile.dialogHandler.ReplyToEmailHandler(inMsgText, ref, userProfile)
 				if err != nil {
-					log.Println("Error changing account")
-					continue
+					log.Println("Error replying to email. ", err)
+					return
 				}
-			case "/changepatterns":
-				if userProfile.dialogHandler.lastSubCommand == "" {
-					msg, err = userProfile.dialogHandler.ChangePatternsHandler(inMsgText, userProfile)
-				} else {
-					msg, err = userProfile.dialogHandler.NewPatternHandler(inMsgText, userProfile)
-				}
-				if err != nil {
-					log.Println("Error changing patterns")
-					continue
+				if msg != nil {
+					if _, err := mgr.messenger.Send(*msg); err != nil {
+						log.Println("Error sending message to user. ", err)
+					}
 				}
+				return
+			}
+		}
+
+		currentCommand := ""
+		if strings.HasPrefix(inMsgText, "/") {
+			currentCommand = inMsgText
+			if strings.HasPrefix(inMsgText, "/quiethours ") {
+				currentCommand = "/quiethours"
+			}
+			userProfile.dialogHandler.CleanTempStores()
+		} else {
+			switch inMsgText {
+			case AddAccount:
+				currentCommand = "/addaccount"
+			case ListAccounts:
+				currentCommand = "/listaccounts"
+			case ChangeAccount:
+				currentCommand = "/changeaccount"
+			case ChangePattern:
+				currentCommand = "/changepatterns"
 			default:
-				msg = userProfile.dialogHandler.SetInitialKeyboard(userProfile.ChatID)
+				currentCommand = userProfile.dialogHandler.lastCommand
 			}
-			if msg == nil {
-				msg = userProfile.dialogHandler.SetInitialKeyboard(userProfile.ChatID)
+		}
+
+		switch currentCommand {
+		case "/start":
+			msg = userProfile.dialogHandler.SetInitialKeyboard(userProfile.ChatID)
+		case "/addaccount":
+			msg, err = userProfile.dialogHandler.AddEmailAccountHandler(inMsg, userProfile)
+
+			if err != nil {
+				log.Println("Error creating account")
+				return
 			}
 
-			_, err := bot.Send(*msg)
+		case "/listaccounts":
+			msg, err = userProfile.dialogHandler.ListAccountsHandler(userProfile)
 			if err != nil {
-				log.Println("Error sending message to user. ", err)
+				log.Println("Error listing account")
+				return
 			}
-			if userProfile.dialogHandler.commandFinished {
-				userProfile.dialogHandler.commandFinished = false
-				msg = userProfile.dialogHandler.SetInitialKeyboard(userProfile.ChatID)
-				_, err := bot.Send(msg)
-				if err != nil {
-					log.Println("Error sending message to user. ", err)
-				}
+		case "/changeaccount":
+			msg, err = userProfile.dialogHandler.ChangeEmailAccountHandler(inMsgText, userProfile)
+			if err != nil {
+				log.Println("Error changing account")
+				return
 			}
+		case "/export", "/export json":
+			msg, err = userProfile.dialogHandler.ExportHandler(inMsgText, userProfile)
+			if err != nil {
+				log.Println("Error exporting settings. ", err)
+				return
+			}
+		case "/import":
+			msg, err = userProfile.dialogHandler.ImportHandler(inMsg, userProfile)
+			if err != nil {
+				log.Println("Error importing settings. ", err)
+				return
+			}
+		case "/quiethours":
+			msg, err = userProfile.dialogHandler.QuietHoursHandler(inMsgText, userProfile)
+			if err != nil {
+				log.Println("Error changing quiet hours. ", err)
+				return
+			}
+		case "/changepatterns":
+			if userProfile.dialogHandler.lastSubCommand == "" {
+				msg, err = userProfile.dialogHandler.ChangePatternsHandler(inMsgText, userProfile)
+			} else {
+				msg, err = userProfile.dialogHandler.NewPatternHandler(inMsgText, userProfile)
+			}
+			if err != nil {
+				log.Println("Error changing patterns")
+				return
+			}
+		default:
+			msg = userProfile.dialogHandler.SetInitialKeyboard(userProfile.ChatID)
+		}
+		if msg == nil {
+			msg = userProfile.dialogHandler.SetInitialKeyboard(userProfile.ChatID)
 		}
 
-		//addaccount - Add mail account
-		//listaccounts - List existing mail accounts
-		//changeaccount - Change account settings (login/password/refresh frequency)
-		//changepatterns - Change patterns for email which to notify
-
+		_, err := mgr.messenger.Send(*msg)
+		if err != nil {
+			log.Println("Error sending message to user. ", err)
+		}
+		if userProfile.dialogHandler.commandFinished {
+			userProfile.dialogHandler.commandFinished = false
+			msg = userProfile.dialogHandler.SetInitialKeyboard(userProfile.ChatID)
+			_, err := mgr.messenger.Send(msg)
+			if err != nil {
+				log.Println("Error sending message to user. ", err)
+			}
+		}
 	}
+
+	//addaccount - Add mail account
+	//listaccounts - List existing mail accounts
+	//changeaccount - Change account settings (login/password/refresh frequency)
+	//changepatterns - Change patterns for email which to notify
+
 }
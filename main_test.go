@@ -1,14 +1,35 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/mail"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
+func TestMain(m *testing.M) {
+	var err error
+	credentials, err = NewCredentialCipher("test master key")
+	if err != nil {
+		fmt.Println("Error creating credentials cipher", err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
 func TestEmailBoxHandler_CheckPatterns(t *testing.T) {
 	type tCase struct {
 		Message imap.Message
@@ -163,141 +184,1933 @@ func TestEmailBoxHandler_CheckPatterns(t *testing.T) {
 	}
 }
 
-func TestAddingAccount(t *testing.T) {
-	bot = &tgbotapi.BotAPI{} //Bad idea, we could receive errors in deleting email
-
+func TestNotifyPatterns_Match(t *testing.T) {
 	type tCase struct {
-		textMessages  []string
-		resultMsgText string //Must contain, not match
-	}
-	newAccount := StoredEmailAccount{
-		id:       0,
-		imapHost: "imap.test.com",
-		login:    "test@test.com",
-		password: "Test123",
-		updateT:  3,
-		isActive: false,
+		Pattern *NotifyPatterns
+		Result  bool
 	}
 
+	msg := &imap.Message{Envelope: &imap.Envelope{
+		Subject: "Build #42 FAILED on master",
+		From:    []*imap.Address{{PersonalName: "Jenkins", MailboxName: "ci@corp"}},
+	}}
 	testCases := []tCase{
 		{
-			textMessages:  []string{AddAccount, "test"},
-			resultMsgText: "Wrong format for login, please set <login>@<domain>",
+			Pattern: &NotifyPatterns{Conditions: []*PatternCondition{
+				{Field: patternFieldFromEmail, Mode: matchEquals, Value: "CI@corp"},
+				{Field: patternFieldSubject, Mode: matchContains, Value: "failed"},
+			}},
+			Result: true,
 		},
 		{
-			textMessages:  []string{AddAccount, newAccount.login, "localhost"},
-			resultMsgText: "Invalid hostname for imap server localhost",
+			Pattern: &NotifyPatterns{Conditions: []*PatternCondition{
+				{Field: patternFieldFromEmail, Mode: matchEquals, Value: "ci@corp"},
+				{Field: patternFieldSubject, Mode: matchContains, Value: "passed"},
+			}},
+			Result: false,
 		},
 		{
-			textMessages:  []string{AddAccount, newAccount.login, "imap.test.com:rr"},
-			resultMsgText: "Invalid imap port in host",
+			Pattern: &NotifyPatterns{Conditions: []*PatternCondition{
+				{Field: patternFieldSubject, Mode: matchContains, Value: "failed", CaseSensitive: true},
+			}},
+			Result: false,
 		},
 		{
-			textMessages:  []string{AddAccount, newAccount.login, newAccount.imapHost, newAccount.password, "1min"},
-			resultMsgText: "Invalid value for update frequency 1min",
+			Pattern: &NotifyPatterns{Conditions: []*PatternCondition{
+				{Field: patternFieldSubject, Mode: matchRegex, Value: `^build #\d+ failed`},
+			}},
+			Result: true,
 		},
 		{
-			textMessages:  []string{AddAccount, newAccount.login, newAccount.imapHost, newAccount.password, strconv.Itoa(newAccount.updateT)},
-			resultMsgText: "Account created",
+			Pattern: &NotifyPatterns{Conditions: []*PatternCondition{
+				{Field: patternFieldSubject, Mode: matchRegex, Value: `^build #\d+ failed`, CaseSensitive: true},
+			}},
+			Result: false,
 		},
 		{
-			textMessages:  []string{AddAccount, newAccount.login, newAccount.imapHost, newAccount.password, strconv.Itoa(newAccount.updateT), AddAccount, newAccount.login, newAccount.imapHost},
-			resultMsgText: "You already have account with this email for this host",
+			Pattern: &NotifyPatterns{Conditions: []*PatternCondition{
+				{Field: patternFieldFromName, Mode: matchEquals, Value: "jenkins"},
+			}},
+			Result: true,
+		},
+		{
+			Pattern: &NotifyPatterns{},
+			Result:  false,
+		},
+		// Patterns stored before conditions hold local part of sender address
+		{
+			Pattern: &NotifyPatterns{FromEmail: "ci"},
+			Result:  true,
+		},
+		{
+			Pattern: &NotifyPatterns{FromEmail: "cd"},
+			Result:  false,
 		},
 	}
-	dialogHandler := UserDialogHandler{
-		lastCommand:     "",
-		lastSubCommand:  "",
-		chatID:          0,
-		newEmailAccount: nil,
-		commandFinished: false,
+	for i, testCase := range testCases {
+		if err := testCase.Pattern.Compile(); err != nil {
+			t.Errorf("[%d] compile error: %v", i, err)
+			continue
+		}
+		if result := testCase.Pattern.Match(msg); result != testCase.Result {
+			t.Errorf("[%d] result mismatch. want: %t, have: %t", i, testCase.Result, result)
+		}
 	}
-	user := &StoredUser{}
-	for i, tCase := range testCases {
-		var lastMsgText string
-		for _, msgText := range tCase.textMessages {
-			inMsg := &tgbotapi.Message{
-				Text: msgText,
-			}
-			outMsg, _ := dialogHandler.AddEmailAccountHandler(inMsg, user)
-			lastMsgText = outMsg.Text
+
+	invalid := &PatternCondition{Field: patternFieldSubject, Mode: matchRegex, Value: "(unclosed"}
+	if err := invalid.Compile(); err == nil {
+		t.Errorf("Invalid regular expression compiled without error")
+	}
+}
+
+func TestEmailBoxHandler_CheckMuteRules(t *testing.T) {
+	type tCase struct {
+		Patterns []*NotifyPatterns
+		Result   bool
+	}
+
+	newsletter := func() *imap.Message {
+		section := &imap.BodySectionName{BodyPartName: imap.BodyPartName{
+			Specifier: imap.HeaderSpecifier,
+			Fields:    []string{"List-Id"},
+		}}
+		return &imap.Message{
+			Envelope: &imap.Envelope{
+				Subject: "Weekly digest",
+				From:    []*imap.Address{{PersonalName: "News", MailboxName: "news", HostName: "lists.example.com"}},
+			},
+			Body: map[*imap.BodySectionName]imap.Literal{
+				section: bytes.NewBufferString("List-Id: Weekly news <weekly.lists.example.com>\r\n\r\n"),
+			},
 		}
-		if !strings.Contains(lastMsgText, tCase.resultMsgText) {
-			t.Errorf("[%d] Text mismatch.\nWant: %s\nHave:%s", i, tCase.resultMsgText, lastMsgText)
+	}
+	muteDomain := &NotifyPatterns{Exclude: true, Conditions: []*PatternCondition{
+		{Field: patternFieldFromDomain, Mode: matchEquals, Value: "lists.example.com"},
+	}}
+	muteList := &NotifyPatterns{Exclude: true, Conditions: []*PatternCondition{
+		{Field: patternFieldListID, Mode: matchContains, Value: "weekly.lists"},
+	}}
+	muteOther := &NotifyPatterns{Exclude: true, Conditions: []*PatternCondition{
+		{Field: patternFieldSubject, Mode: matchContains, Value: "sale"},
+	}}
+	includeDigest := &NotifyPatterns{Conditions: []*PatternCondition{
+		{Field: patternFieldSubject, Mode: matchContains, Value: "digest"},
+	}}
+	testCases := []tCase{
+		{Patterns: []*NotifyPatterns{muteDomain}, Result: false},
+		{Patterns: []*NotifyPatterns{muteList}, Result: false},
+		{Patterns: []*NotifyPatterns{muteOther}, Result: true},
+		{Patterns: []*NotifyPatterns{includeDigest, muteList}, Result: false},
+		{Patterns: []*NotifyPatterns{includeDigest, muteOther}, Result: true},
+	}
+	for i, testCase := range testCases {
+		boxHandler := EmailBoxHandler{user: &StoredUser{Patterns: testCase.Patterns}}
+		if result := boxHandler.CheckPatterns(newsletter()); result != testCase.Result {
+			t.Errorf("[%d] result mismatch. want: %t, have: %t", i, testCase.Result, result)
 		}
 	}
 }
 
-func TestUserDialogHandler_ListAccountsHandler(t *testing.T) {
-	bot = &tgbotapi.BotAPI{} //Bad idea, we could receive errors in deleting email
+func TestNotifyPatterns_MatchHeadersAndBody(t *testing.T) {
+	type tCase struct {
+		Condition *PatternCondition
+		Result    bool
+	}
+
+	rawEmail := "X-Jenkins-Job: deploy-prod\r\n" +
+		"X-Priority: 1 (Highest)\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Deployment =E2=84=96 7 finished with ERROR\r\n"
+	newMessage := func() *imap.Message {
+		header := &imap.BodySectionName{BodyPartName: imap.BodyPartName{
+			Specifier: imap.HeaderSpecifier,
+			Fields:    []string{"X-Jenkins-Job", "X-Priority"},
+		}}
+		body := &imap.BodySectionName{Partial: []int{0}}
+		return &imap.Message{
+			Envelope: &imap.Envelope{
+				To: []*imap.Address{{MailboxName: "oncall", HostName: "corp.test"}},
+				Cc: []*imap.Address{{MailboxName: "team-lead", HostName: "corp.test"}},
+			},
+			Body: map[*imap.BodySectionName]imap.Literal{
+				header: bytes.NewBufferString("X-Jenkins-Job: deploy-prod\r\nX-Priority: 1 (Highest)\r\n\r\n"),
+				body:   bytes.NewBufferString(rawEmail),
+			},
+		}
+	}
+	testCases := []tCase{
+		{&PatternCondition{Field: patternFieldHeader, Header: "x-jenkins-job", Mode: matchEquals, Value: "deploy-prod"}, true},
+		{&PatternCondition{Field: patternFieldHeader, Header: "X-Priority", Mode: matchRegex, Value: `^[12]\b`}, true},
+		{&PatternCondition{Field: patternFieldHeader, Header: "X-Mailer", Mode: matchContains, Value: "a"}, false},
+		{&PatternCondition{Field: patternFieldTo, Mode: matchEquals, Value: "oncall@corp.test"}, true},
+		{&PatternCondition{Field: patternFieldCc, Mode: matchEquals, Value: "oncall@corp.test"}, false},
+		{&PatternCondition{Field: patternFieldBody, Mode: matchContains, Value: "№ 7 finished with error"}, true},
+		{&PatternCondition{Field: patternFieldBody, Mode: matchContains, Value: "success"}, false},
+	}
+	for i, testCase := range testCases {
+		pattern := &NotifyPatterns{Conditions: []*PatternCondition{testCase.Condition}}
+		if err := pattern.Compile(); err != nil {
+			t.Errorf("[%d] compile error: %v", i, err)
+			continue
+		}
+		if result := pattern.Match(newMessage()); result != testCase.Result {
+			t.Errorf("[%d] result mismatch. want: %t, have: %t", i, testCase.Result, result)
+		}
+	}
+
+	items := patternsFetchItems([]*NotifyPatterns{
+		{Conditions: []*PatternCondition{{Field: patternFieldSubject}, {Field: patternFieldListID}}},
+		{Conditions: []*PatternCondition{{Field: patternFieldHeader, Header: "list-id"}, {Field: patternFieldBody}}},
+	})
+	wantItems := []imap.FetchItem{"BODY.PEEK[HEADER.FIELDS (List-Id)]", imap.FetchItem(fmt.Sprintf("BODY.PEEK[]<0.%d>", maxPatternBodySize))}
+	if !reflect.DeepEqual(items, wantItems) {
+		t.Errorf("Fetch items mismatch. want: %v, have: %v", wantItems, items)
+	}
+	if items := patternsFetchItems([]*NotifyPatterns{{Subject: "report"}}); len(items) != 0 {
+		t.Errorf("Envelope patterns need additional fetch items: %v", items)
+	}
+}
 
+func TestNotifyPatterns_MatchAddresses(t *testing.T) {
 	type tCase struct {
-		textMessages  []string
-		resultMsgText string //Must contain, not match
-		inListStr     string
+		Condition *PatternCondition
+		Result    bool
 	}
-	newAccount1 := StoredEmailAccount{
-		id:       0,
-		imapHost: "imap.test.com",
-		login:    "test@test.com",
-		password: "Test123",
-		updateT:  3,
-		isActive: false,
+
+	msg := &imap.Message{Envelope: &imap.Envelope{
+		From: []*imap.Address{{PersonalName: "Alerts", MailboxName: "alerts", HostName: "mon.example.com"}},
+		To:   []*imap.Address{{MailboxName: "dev", HostName: "corp.test"}},
+	}}
+	testCases := []tCase{
+		{&PatternCondition{Field: patternFieldFromEmail, Mode: matchEquals, Value: "Alerts@mon.example.com"}, true},
+		{&PatternCondition{Field: patternFieldFromEmail, Mode: matchEquals, Value: "alerts@example.com"}, false},
+		{&PatternCondition{Field: patternFieldFromEmail, Mode: matchDomain, Value: "example.com"}, true},
+		{&PatternCondition{Field: patternFieldFromEmail, Mode: matchDomain, Value: "ample.com"}, false},
+		{&PatternCondition{Field: patternFieldFromDomain, Mode: matchDomain, Value: "mon.example.com"}, true},
+		{&PatternCondition{Field: patternFieldFromEmail, Mode: matchGlob, Value: "*@*.example.com"}, true},
+		{&PatternCondition{Field: patternFieldFromEmail, Mode: matchGlob, Value: "*@example.com"}, false},
+		{&PatternCondition{Field: patternFieldFromEmail, Mode: matchGlob, Value: "alert?@mon.example.*"}, true},
+		{&PatternCondition{Field: patternFieldTo, Mode: matchGlob, Value: "dev@corp.test"}, true},
+		{&PatternCondition{Field: patternFieldSubject, Mode: matchGlob, Value: "*"}, true},
 	}
-	newAccount2 := StoredEmailAccount{
-		id:       0,
-		imapHost: "imap.test2.com",
-		login:    "test2@test2.com",
-		password: "Test123",
-		updateT:  7,
-		isActive: false,
+	for i, testCase := range testCases {
+		pattern := &NotifyPatterns{Conditions: []*PatternCondition{testCase.Condition}}
+		if err := pattern.Compile(); err != nil {
+			t.Errorf("[%d] compile error: %v", i, err)
+			continue
+		}
+		if result := pattern.Match(msg); result != testCase.Result {
+			t.Errorf("[%d] result mismatch. want: %t, have: %t", i, testCase.Result, result)
+		}
 	}
 
-	addingAccountSteps := []tCase{
-		{
-			textMessages:  []string{AddAccount, newAccount1.login, newAccount1.imapHost, newAccount1.password, strconv.Itoa(newAccount1.updateT)},
-			resultMsgText: "Account created",
-			inListStr:     fmt.Sprintf("Login: %s, timeout: %d min, active: %t\n", newAccount1.login, newAccount1.updateT, true),
-		},
-		{
-			textMessages:  []string{AddAccount, newAccount2.login, newAccount2.imapHost, newAccount2.password, strconv.Itoa(newAccount2.updateT)},
-			resultMsgText: "Account created",
-			inListStr:     fmt.Sprintf("Login: %s, timeout: %d min, active: %t\n", newAccount2.login, newAccount2.updateT, true),
+	invalid := []*PatternCondition{
+		{Field: patternFieldFromEmail, Mode: matchEquals, Value: "alerts"},
+		{Field: patternFieldFromEmail, Mode: matchDomain, Value: "alerts@example.com"},
+		{Field: patternFieldSubject, Mode: matchDomain, Value: "example.com"},
+	}
+	for i, condition := range invalid {
+		if err := condition.Compile(); err == nil {
+			t.Errorf("[%d] invalid condition compiled without error", i)
+		}
+	}
+}
+
+func TestUserDialogHandler_EditPattern(t *testing.T) {
+	pattern := &NotifyPatterns{ID: 5, Subject: "report", AccountIDs: []int{7}}
+	user := &StoredUser{Patterns: []*NotifyPatterns{pattern}}
+	h := &UserDialogHandler{}
+
+	if _, err := h.EditPatternHandler("eid_5", user); err != nil {
+		t.Fatalf("Error starting edit: %v", err)
+	}
+	for _, msg := range []string{"pedc_0", "nsbj", "pm_" + matchRegex, "^weekly report$", "pcond_add", "semail",
+		"pm_" + matchDomain, "@example.com", "psave"} {
+		if _, err := h.NewPatternHandler(msg, user); err != nil {
+			t.Fatalf("Error handling %q: %v", msg, err)
+		}
+	}
+
+	if len(user.Patterns) != 1 || user.Patterns[0] != pattern {
+		t.Fatalf("Pattern was not changed in place: %v", user.Patterns)
+	}
+	if pattern.ID != 5 || pattern.Subject != "" || !reflect.DeepEqual(pattern.AccountIDs, []int{7}) {
+		t.Errorf("Pattern data mismatch: %+v", pattern)
+	}
+	want := `subject regex "^weekly report$" AND from email domain "example.com"`
+	if pattern.String() != want {
+		t.Errorf("Pattern conditions mismatch. want: %s, have: %s", want, pattern.String())
+	}
+	if h.lastSubCommand != "" || h.editPatternID != 0 {
+		t.Errorf("Dialog state is not reset after save")
+	}
+}
+
+func TestEmailBoxHandler_TestPatternMessage(t *testing.T) {
+	type tCase struct {
+		Pattern *NotifyPatterns
+		Matched bool
+		Muted   bool
+	}
+
+	muteBots := &NotifyPatterns{ID: 1, Exclude: true, Conditions: []*PatternCondition{
+		{Field: patternFieldFromEmail, Mode: matchGlob, Value: "noreply@*"},
+	}}
+	boxHandler := EmailBoxHandler{
+		eAccount: &StoredEmailAccount{id: 1},
+		user:     &StoredUser{Patterns: []*NotifyPatterns{muteBots}},
+	}
+	msg := &imap.Message{Envelope: &imap.Envelope{
+		Subject: "Invoice 42",
+		From:    []*imap.Address{{MailboxName: "noreply", HostName: "shop.test"}},
+	}}
+	testCases := []tCase{
+		{Pattern: &NotifyPatterns{ID: 2, Conditions: []*PatternCondition{
+			{Field: patternFieldSubject, Mode: matchContains, Value: "invoice"},
+		}}, Matched: true, Muted: true},
+		{Pattern: &NotifyPatterns{ID: 2, Conditions: []*PatternCondition{
+			{Field: patternFieldSubject, Mode: matchContains, Value: "receipt"},
+		}}, Matched: false, Muted: false},
+		// Edited mute rule is tested instead of its saved version
+		{Pattern: &NotifyPatterns{ID: 1, Exclude: true, Conditions: []*PatternCondition{
+			{Field: patternFieldFromDomain, Mode: matchEquals, Value: "shop.test"},
+		}}, Matched: true, Muted: false},
+	}
+	for i, testCase := range testCases {
+		matched, muted := boxHandler.testPatternMessage(testCase.Pattern, msg)
+		if matched != testCase.Matched || muted != testCase.Muted {
+			t.Errorf("[%d] result mismatch. want: %t/%t, have: %t/%t", i, testCase.Matched, testCase.Muted, matched, muted)
+		}
+	}
+}
+
+func TestEmailBoxHandler_CheckPatternScope(t *testing.T) {
+	type tCase struct {
+		AccountID int
+		Result    bool
+	}
+
+	user := &StoredUser{Patterns: []*NotifyPatterns{
+		{AccountIDs: []int{1}, Conditions: []*PatternCondition{
+			{Field: patternFieldSubject, Mode: matchContains, Value: "deploy"},
+		}},
+		{AccountIDs: []int{2}, Exclude: true, Conditions: []*PatternCondition{
+			{Field: patternFieldSubject, Mode: matchContains, Value: "deploy"},
+		}},
+	}}
+	msg := &imap.Message{Envelope: &imap.Envelope{Subject: "Deploy finished"}}
+	testCases := []tCase{
+		{AccountID: 1, Result: true},
+		{AccountID: 2, Result: false},
+		// Only patterns of other accounts: notify about everything
+		{AccountID: 3, Result: true},
+	}
+	for i, testCase := range testCases {
+		boxHandler := EmailBoxHandler{eAccount: &StoredEmailAccount{id: testCase.AccountID}, user: user}
+		if result := boxHandler.CheckPatterns(msg); result != testCase.Result {
+			t.Errorf("[%d] result mismatch. want: %t, have: %t", i, testCase.Result, result)
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	account := &StoredEmailAccount{id: 1, login: "dev@corp.test", imapHost: "imap.corp.test:993", updateT: 5, password: "secret"}
+	user := &StoredUser{
+		Patterns: []*NotifyPatterns{
+			{ID: 3, Subject: "report"},
+			{ID: 4, AccountIDs: []int{1}, Conditions: []*PatternCondition{
+				{Field: patternFieldHeader, Header: "X-Jenkins-Job", Mode: matchEquals, Value: "deploy"},
+			}},
 		},
 	}
+	user.emailBoxHandlers = []*EmailBoxHandler{{eAccount: account, user: user}}
 
-	dialogHandler := UserDialogHandler{
-		lastCommand:     "",
-		lastSubCommand:  "",
-		chatID:          0,
-		newEmailAccount: nil,
-		commandFinished: false,
+	exported, err := yaml.Marshal(newExportDocument(user))
+	if err != nil {
+		t.Fatalf("Error exporting: %v", err)
 	}
-	var listTotalStr string
-	var wantAccounts int
-	user := &StoredUser{}
-	for i, tCase := range addingAccountSteps {
-		var lastMsgText string
-		for _, msgText := range tCase.textMessages {
-			inMsg := &tgbotapi.Message{
-				Text: msgText,
-			}
-			outMsg, _ := dialogHandler.AddEmailAccountHandler(inMsg, user)
-			lastMsgText = outMsg.Text
+	if strings.Contains(string(exported), "secret") {
+		t.Errorf("Password is exported:\n%s", exported)
+	}
+	doc, err := parseImportDocument(exported)
+	if err != nil {
+		t.Fatalf("Error parsing export: %v", err)
+	}
+	imp, err := doc.toImport(user)
+	if err != nil {
+		t.Fatalf("Error validating export: %v", err)
+	}
+	if diff := imp.diff(user); diff != "No changes" {
+		t.Errorf("Export and import of same settings has changes:\n%s", diff)
+	}
+
+	changed := `{
+  "accounts": [{"login": "dev@corp.test", "imap_host": "imap.corp.test:993", "timeout_min": 10, "folders": ["INBOX", "Alerts"]}],
+  "patterns": [
+    {"id": 4, "accounts": ["dev@corp.test"], "conditions": [{"field": "header", "header": "X-Jenkins-Job", "mode": "equals", "value": "deploy-prod"}]},
+    {"mute": true, "conditions": [{"field": "from_domain", "mode": "domain", "value": "news.test"}]}
+  ]
+}`
+	doc, err = parseImportDocument([]byte(changed))
+	if err != nil {
+		t.Fatalf("Error parsing JSON import: %v", err)
+	}
+	imp, err = doc.toImport(user)
+	if err != nil {
+		t.Fatalf("Error validating import: %v", err)
+	}
+	diff := imp.diff(user)
+	for _, want := range []string{"timeout_min: 5 → 10", "- subject contains", `"deploy" [accounts: dev@corp.test] → `, "+ Mute: from domain domain"} {
+		if !strings.Contains(diff, want) {
+			t.Errorf("Diff doesn't contain %q:\n%s", want, diff)
 		}
+	}
+	imp.apply(user)
+	if len(user.Patterns) != 2 || user.Patterns[0].ID != 4 || !user.Patterns[1].Exclude {
+		t.Errorf("Patterns are not imported: %v", user.Patterns)
+	}
+	if account.updateT != 10 || !reflect.DeepEqual(account.monitoredFolders(), []string{"INBOX", "Alerts"}) {
+		t.Errorf("Account settings are not imported: %d %v", account.updateT, account.monitoredFolders())
+	}
 
-		if !strings.Contains(lastMsgText, tCase.resultMsgText) {
-			t.Errorf("[%d] Add Text mismatch.\nWant: %s\nHave:%s", i, tCase.resultMsgText, lastMsgText)
-			t.Fail()
+	for i, invalid := range []string{
+		"",
+		"patterns:\n  - id: 1\n    conditons: []\n",
+		"patterns:\n  - conditions: [{field: subject, mode: regex, value: '('}]\n",
+		"patterns:\n  - accounts: [other@corp.test]\n    conditions: [{field: subject, mode: contains, value: a}]\n",
+		"accounts:\n  - login: new@corp.test\n    imap_host: imap.corp.test:993\n    timeout_min: 5\n",
+	} {
+		doc, err := parseImportDocument([]byte(invalid))
+		if err == nil {
+			_, err = doc.toImport(user)
 		}
-		listTotalStr += tCase.inListStr
-		wantAccounts += 1
-		wantTest := fmt.Sprintf("You have %d email accounts:\n", wantAccounts) + listTotalStr
-		listMsg, _ := dialogHandler.ListAccountsHandler(user)
-		if listMsg.Text != wantTest {
-			t.Errorf("[%d] List Text mismatch.\nWant: %s\nHave:%s", i, listTotalStr, listMsg.Text)
-			t.Fail()
+		if err == nil {
+			t.Errorf("[%d] invalid document is accepted", i)
+		}
+	}
+}
+
+func TestDigestSchedule(t *testing.T) {
+	type tCase struct {
+		Text string
+		Spec string
+		Next string
+	}
+
+	now := time.Date(2024, 5, 10, 12, 30, 0, 0, time.UTC)
+	testCases := []tCase{
+		{"off", "", ""},
+		{"30", "30m", "2024-05-10 13:00"},
+		{"2h", "120m", "2024-05-10 14:30"},
+		{"18:00, 9:00", "09:00, 18:00", "2024-05-10 18:00"},
+		{"09:00,12:30", "09:00, 12:30", "2024-05-11 09:00"},
+	}
+	for i, testCase := range testCases {
+		schedule, err := ParseDigestSchedule(testCase.Text)
+		if err != nil {
+			t.Errorf("[%d] parse error: %v", i, err)
+			continue
+		}
+		if spec := schedule.spec(); spec != testCase.Spec {
+			t.Errorf("[%d] spec mismatch. want: %q, have: %q", i, testCase.Spec, spec)
+		}
+		if schedule == nil {
+			continue
+		}
+		if next := schedule.next(now).Format("2006-01-02 15:04"); next != testCase.Next {
+			t.Errorf("[%d] next time mismatch. want: %s, have: %s", i, testCase.Next, next)
+		}
+	}
+	for i, invalid := range []string{"0", "soon", "25:00", "09:00, noon"} {
+		if _, err := ParseDigestSchedule(invalid); err == nil {
+			t.Errorf("[%d] invalid schedule %q is accepted", i, invalid)
+		}
+	}
+}
+
+func TestEmailBoxHandler_Digest(t *testing.T) {
+	hourly := &DigestSchedule{IntervalMin: 60}
+	evening := &DigestSchedule{Times: []string{"18:00"}}
+	releases := &NotifyPatterns{ID: 1, Digest: evening, Conditions: []*PatternCondition{
+		{Field: patternFieldSubject, Mode: matchContains, Value: "release"},
+	}}
+	alerts := &NotifyPatterns{ID: 2, Conditions: []*PatternCondition{
+		{Field: patternFieldSubject, Mode: matchContains, Value: "alert"},
+	}}
+	user := &StoredUser{Patterns: []*NotifyPatterns{releases, alerts}}
+	handler := &EmailBoxHandler{eAccount: &StoredEmailAccount{id: 1, login: "dev@corp.test", digest: hourly}, user: user}
+	if schedule := handler.digestSchedule(releases); schedule != evening {
+		t.Errorf("Schedule of pattern is not used: %v", schedule)
+	}
+	if schedule := handler.digestSchedule(alerts); schedule != hourly {
+		t.Errorf("Schedule of account is not used: %v", schedule)
+	}
+	urgent := &NotifyPatterns{ID: 3, Priority: priorityUrgent}
+	if schedule := handler.digestSchedule(urgent); schedule != nil {
+		t.Errorf("Urgent notification is buffered: %v", schedule)
+	}
+	handler.eAccount.digest = nil
+	if schedule := handler.digestSchedule(alerts); schedule != nil {
+		t.Errorf("Notification without digest is buffered: %v", schedule)
+	}
+
+	now := time.Date(2024, 5, 10, 12, 30, 0, 0, time.Local)
+	emails := []struct {
+		account string
+		from    string
+		subject string
+	}{
+		{"dev@corp.test", "ci@corp.test", "Build failed"},
+		{"dev@corp.test", "ci@corp.test", "Build failed"},
+		{"dev@corp.test", "ci@corp.test", "Build fixed"},
+		{"dev@corp.test", "boss@corp.test", "Meeting"},
+		{"home@mail.test", "shop@store.test", "Order shipped"},
+	}
+	for _, email := range emails {
+		user.digests.add(hourly, &DigestEntry{Account: email.account, From: email.from, Subject: email.subject}, now)
+	}
+	user.digests.add(evening, &DigestEntry{Account: "dev@corp.test", From: "ci@corp.test", Subject: "Release 1.2"}, now)
+	if due := user.digests.takeDue(now.Add(59 * time.Minute)); len(due) != 0 {
+		t.Errorf("Digest is sent too early: %v", due)
+	}
+	due := user.digests.takeDue(now.Add(time.Hour))
+	if len(due) != 1 || len(due[0].Entries) != len(emails) {
+		t.Fatalf("Hourly digest is not due: %v", due)
+	}
+	text := formatDigest(due[0])
+	for _, want := range []string{"Digest: 5 new emails", "dev@corp.test (4)\n• ci@corp.test: 3\n    Build failed ×2\n    Build fixed\n• boss@corp.test: 1",
+		"home@mail.test (1)"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Digest doesn't contain %q:\n%s", want, text)
+		}
+	}
+	if batches := user.digests.snapshot(); len(batches) != 1 || batches[0].Due.Hour() != 18 {
+		t.Errorf("Evening digest is not kept: %v", batches)
+	}
+
+	// Digest which is not delivered to Telegram is sent on next check
+	messenger := &fakeMessenger{sendErr: fmt.Errorf("telegram is down")}
+	user.messenger = messenger
+	evening18 := now.Add(5*time.Hour + 30*time.Minute)
+	user.SendDueDigests(evening18)
+	if batches := user.digests.snapshot(); len(batches) != 1 || len(batches[0].Entries) != 1 ||
+		!batches[0].Due.Equal(evening18.Add(digestCheckT)) {
+		t.Errorf("Failed digest is not kept: %v", batches)
+	}
+	messenger.sendErr = nil
+	user.SendDueDigests(evening18.Add(digestCheckT))
+	if texts := messenger.texts(); len(texts) != 1 || !strings.Contains(texts[0], "Release 1.2") {
+		t.Errorf("Failed digest is not sent again: %v", texts)
+	}
+	if batches := user.digests.snapshot(); len(batches) != 0 {
+		t.Errorf("Sent digest is kept: %v", batches)
+	}
+
+	msg := &imap.Message{Envelope: &imap.Envelope{Subject: "Hi", From: []*imap.Address{
+		{PersonalName: "Tom & Jerry", MailboxName: "tj", HostName: "corp.test"},
+	}}}
+	if entry := newDigestEntry("dev@corp.test", msg); entry.From != "Tom & Jerry <tj@corp.test>" {
+		t.Errorf("Wrong sender in digest: %s", entry.From)
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	type tCase struct {
+		Now   time.Time
+		Delay bool
+		Until string
+	}
+
+	quietHours, err := ParseQuietHours("23:00-07:00 Europe/Moscow")
+	if err != nil {
+		t.Fatalf("Error parsing quiet hours: %v", err)
+	}
+	if quietHours.spec() != "23:00-07:00 Europe/Moscow delay" {
+		t.Errorf("Wrong quiet hours: %s", quietHours.spec())
+	}
+	user := &StoredUser{QuietHours: quietHours}
+	// Moscow is UTC+3
+	testCases := []tCase{
+		{time.Date(2024, 5, 10, 19, 59, 0, 0, time.UTC), false, ""},
+		{time.Date(2024, 5, 10, 20, 0, 0, 0, time.UTC), true, "2024-05-11 07:00"},
+		{time.Date(2024, 5, 11, 1, 30, 0, 0, time.UTC), true, "2024-05-11 07:00"},
+		{time.Date(2024, 5, 11, 4, 0, 0, 0, time.UTC), false, ""},
+	}
+	for i, testCase := range testCases {
+		until, delay, silent := user.quietDelivery(nil, testCase.Now)
+		if delay != testCase.Delay || silent {
+			t.Errorf("[%d] delivery mismatch. want delay: %t, have delay: %t, silent: %t", i, testCase.Delay, delay, silent)
+		}
+		if delay && until.Format("2006-01-02 15:04") != testCase.Until {
+			t.Errorf("[%d] end of quiet hours mismatch. want: %s, have: %s", i, testCase.Until, until.Format("2006-01-02 15:04"))
 		}
 	}
 
+	night := time.Date(2024, 5, 10, 22, 0, 0, 0, time.UTC)
+	urgent := &NotifyPatterns{Priority: priorityUrgent}
+	if _, delay, silent := user.quietDelivery(urgent, night); delay || silent {
+		t.Errorf("Urgent pattern is not notified during quiet hours")
+	}
+	if _, delay, silent := user.quietDelivery(&NotifyPatterns{RequiresAck: true}, night); delay || !silent {
+		t.Errorf("Notification which requires acknowledgement is delayed during quiet hours")
+	}
+	user.QuietHours.Mode = quietModeSilent
+	if _, delay, silent := user.quietDelivery(&NotifyPatterns{}, night); delay || !silent {
+		t.Errorf("Notification is not silent during quiet hours")
+	}
+
+	for i, invalid := range []string{"23:00", "23:00-23:00", "23:00-07:00 Mars/Base", "23:00-7 delay", "1-2 UTC delay x"} {
+		if _, err := ParseQuietHours(invalid); err == nil {
+			t.Errorf("[%d] invalid quiet hours %q are accepted", i, invalid)
+		}
+	}
+}
+
+func TestUrgentNotifications(t *testing.T) {
+	notification := &EmailNotification{AccountID: 1, Account: "dev@corp.test", Folder: "INBOX", UID: 7, Priority: priorityUrgent}
+	if text := notification.Format(); !strings.HasPrefix(text, "🚨 <b>URGENT</b>\n") {
+		t.Errorf("Urgent notification has no marker:\n%s", text)
+	}
+	keyboard, ok := notificationKeyboard(notification.ref(), true)
+	if !ok || *keyboard.InlineKeyboard[0][0].CallbackData != "ea:ak:1:7:INBOX" {
+		t.Errorf("Urgent notification has no Acknowledge button: %v", keyboard)
+	}
+	keyboard, _ = notificationKeyboard(notification.ref(), false)
+	if *keyboard.InlineKeyboard[0][0].CallbackData == "ea:ak:1:7:INBOX" {
+		t.Errorf("Normal notification has Acknowledge button")
+	}
+
+	var acks ackQueue
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	resendT := time.Duration(*UrgentResendT) * time.Minute
+	acks.track(notification, 100, now)
+	if due, _ := acks.takeDue(now.Add(resendT - time.Second)); len(due) != 0 {
+		t.Errorf("Notification is re-sent too early")
+	}
+	for i := 1; i <= urgentResendLimit; i++ {
+		now = now.Add(resendT)
+		due, expired := acks.takeDue(now)
+		if len(due) != 1 || due[0].Sent != i || len(expired) != 0 {
+			t.Fatalf("[%d] notification is not re-sent: %v %v", i, due, expired)
+		}
+		acks.track(notification, 100+i, now)
+	}
+	due, expired := acks.takeDue(now.Add(resendT))
+	if len(due) != 0 || len(acks.snapshot()) != 0 {
+		t.Errorf("Notification is re-sent more than %d times", urgentResendLimit)
+	}
+	if len(expired) != 1 || expired[0].MessageID != 100+urgentResendLimit {
+		t.Errorf("Expired notification is not returned: %v", expired)
+	}
+
+	acks.track(notification, 200, now)
+	if ack := acks.remove(notification.ref()); ack == nil || ack.MessageID != 200 {
+		t.Errorf("Acknowledged notification is not found: %v", ack)
+	}
+	if due, _ := acks.takeDue(now.Add(resendT)); len(due) != 0 {
+		t.Errorf("Acknowledged notification is re-sent")
+	}
+}
+
+func TestEmailBoxHandler_SendNotification(t *testing.T) {
+	messenger := &fakeMessenger{}
+	user := &StoredUser{ChatID: 100500, messenger: messenger}
+	handler := &EmailBoxHandler{eAccount: &StoredEmailAccount{id: 1}, user: user, messenger: messenger}
+	user.emailBoxHandlers = []*EmailBoxHandler{handler}
+
+	handler.SendNotification(&EmailNotification{AccountID: 1, Folder: "INBOX", UID: 1, Priority: priorityLow})
+	urgent := &EmailNotification{AccountID: 1, Folder: "INBOX", UID: 2, Priority: priorityUrgent}
+	handler.SendNotification(urgent)
+	if len(messenger.sent) != 2 {
+		t.Fatalf("Notifications are not sent: %v", messenger.sent)
+	}
+	if msg := messenger.sent[0].(tgbotapi.MessageConfig); !msg.DisableNotification || msg.ChatID != user.ChatID {
+		t.Errorf("Low priority notification is sent with sound or to wrong chat: %v", msg)
+	}
+	if !reflect.DeepEqual(messenger.pinned, []int{2}) {
+		t.Errorf("Urgent notification is not pinned: %v", messenger.pinned)
+	}
+	if reply := user.Acknowledge(urgent.ref()); reply != "Acknowledged" || !reflect.DeepEqual(messenger.unpinned, []int{2}) {
+		t.Errorf("Acknowledged notification is not unpinned: %s %v", reply, messenger.unpinned)
+	}
+
+	// Failed re-send is counted, so it isn't retried at every check and stops at limit
+	handler.SendNotification(urgent)
+	messenger.sendErr = fmt.Errorf("telegram is down")
+	now := time.Now()
+	for i := 0; i <= urgentResendLimit; i++ {
+		now = now.Add(time.Duration(*UrgentResendT) * time.Minute)
+		user.ResendUnacknowledged(now)
+		if due, _ := user.acks.takeDue(now); len(due) != 0 {
+			t.Fatalf("[%d] Notification is due again after failed re-send", i)
+		}
+	}
+	if acks := user.acks.snapshot(); len(acks) != 0 {
+		t.Errorf("Urgent notification is re-sent after limit: %v", acks[0])
+	}
+	// Message is unpinned after acknowledgement, before every re-send and when notification expires
+	if unpinned := messenger.unpinned; len(unpinned) != urgentResendLimit+2 {
+		t.Errorf("Expired urgent notification is not unpinned: %v", unpinned)
+	}
+}
+
+func TestStoredUser_ResendUnacknowledged(t *testing.T) {
+	quietHours, err := ParseQuietHours("23:00-07:00 UTC")
+	if err != nil {
+		t.Fatalf("Error parsing quiet hours: %v", err)
+	}
+	messenger := &fakeMessenger{}
+	user := &StoredUser{ChatID: 100500, messenger: messenger, QuietHours: quietHours}
+	handler := &EmailBoxHandler{eAccount: &StoredEmailAccount{id: 1}, user: user, messenger: messenger}
+	user.emailBoxHandlers = []*EmailBoxHandler{handler}
+
+	urgent := &EmailNotification{AccountID: 1, Folder: "INBOX", UID: 1, Priority: priorityUrgent}
+	needsAck := &EmailNotification{AccountID: 1, Folder: "INBOX", UID: 2, RequiresAck: true}
+	handler.SendNotification(urgent)
+	handler.SendNotification(needsAck)
+	// Reminders are sent at night, after notifications were sent with sound
+	now := time.Date(2024, 5, 10, 1, 0, 0, 0, time.UTC)
+	for _, ack := range user.acks.pending {
+		ack.Next = now
+	}
+	user.ResendUnacknowledged(now)
+	if len(messenger.sent) != 4 {
+		t.Fatalf("Reminders are not sent: %v", messenger.sent)
+	}
+	for i, sent := range messenger.sent[2:] {
+		msg := sent.(tgbotapi.MessageConfig)
+		if isUrgent := strings.Contains(msg.Text, "URGENT"); msg.DisableNotification == isUrgent {
+			t.Errorf("[%d] Reminder sound doesn't follow quiet hours. Urgent: %t, silent: %t", i, isUrgent, msg.DisableNotification)
+		}
+	}
+
+	// Reminders which are sent after acknowledgement don't start tracking again
+	pinned := len(messenger.pinned)
+	user.Acknowledge(urgent.ref())
+	user.Acknowledge(needsAck.ref())
+	handler.SendNotification(urgent)
+	handler.SendNotification(needsAck)
+	if acks := user.acks.snapshot(); len(acks) != 0 {
+		t.Errorf("Acknowledged notification is tracked again: %v", acks[0])
+	}
+	if len(messenger.pinned) != pinned {
+		t.Errorf("Acknowledged notification is pinned again: %v", messenger.pinned)
+	}
+}
+
+func TestEmailBoxHandler_SendLongMessageToUser(t *testing.T) {
+	type tCase struct {
+		text       string
+		wantChunks int
+	}
+	testCases := []tCase{
+		{strings.Repeat("я", telegramMessageLimit+10), 2},
+		// Raw 8-bit text of badly encoded email
+		{strings.Repeat("\xe9", 5000), 1},
+		{strings.Repeat("a\xe9", 5000), 3},
+	}
+	for i, tCase := range testCases {
+		messenger := &fakeMessenger{}
+		handler := &EmailBoxHandler{eAccount: &StoredEmailAccount{id: 1}, user: &StoredUser{}, messenger: messenger}
+		handler.SendLongMessageToUser(tCase.text)
+		texts := messenger.texts()
+		if len(texts) != tCase.wantChunks {
+			t.Errorf("[%d] Chunks count mismatch. want: %d, have: %d", i, tCase.wantChunks, len(texts))
+		}
+		for _, text := range texts {
+			if !utf8.ValidString(text) || utf8.RuneCountInString(text) > telegramMessageLimit {
+				t.Errorf("[%d] Chunk is invalid or too long: %d runes", i, utf8.RuneCountInString(text))
+			}
+		}
+	}
+}
+
+func TestAckReminders(t *testing.T) {
+	defaultReminderT := *AckReminderT
+	*AckReminderT = 5
+	defer func() { *AckReminderT = defaultReminderT }()
+
+	notification := &EmailNotification{AccountID: 1, Folder: "Alerts", UID: 3, RequiresAck: true}
+	var acks ackQueue
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	acks.track(notification, 100, now)
+	wantIntervals := []time.Duration{10, 20, 40, 80, 120, 120}
+	for i, want := range wantIntervals {
+		due, _ := acks.takeDue(acks.snapshot()[0].Next)
+		if len(due) != 1 {
+			t.Fatalf("[%d] reminder is not sent", i)
+		}
+		now = due[0].Next
+		acks.track(notification, 101+i, now)
+		if interval := acks.snapshot()[0].Next.Sub(now); interval != want*time.Minute {
+			t.Errorf("[%d] reminder interval mismatch. want: %v, have: %v", i, want*time.Minute, interval)
+		}
+	}
+	if text := notification.Format(); strings.Contains(text, "URGENT") {
+		t.Errorf("Notification which requires acknowledgement is marked urgent:\n%s", text)
+	}
+	notification.Reminder = 2
+	if text := notification.Format(); !strings.HasPrefix(text, "🔔 <b>Reminder 2</b>") {
+		t.Errorf("Reminder has no marker:\n%s", text)
+	}
+	if uids := acks.folderUIDs(1, "Alerts"); !reflect.DeepEqual(uids, []uint32{3}) {
+		t.Errorf("Wrong emails waiting for acknowledgement: %v", uids)
+	}
+	if uids := acks.folderUIDs(1, "INBOX"); len(uids) != 0 {
+		t.Errorf("Wrong emails waiting for acknowledgement in other folder: %v", uids)
+	}
+}
+
+func TestConvertSieve(t *testing.T) {
+	type tCase struct {
+		Subject string
+		From    string
+		Result  *NotifyPatterns
+	}
+
+	script := `require ["fileinto", "reject"];
+# Newsletters are not interesting
+if anyof (address :domain "from" "news.test", header :contains "list-id" "announce") {
+	discard;
+	stop;
+} elsif allof (header :contains "subject" ["deploy", "release"],
+               not address :is "from" "bot@ci.test") {
+	fileinto "Deploys";
+} elsif size :over 1M {
+	fileinto "Large";
+} else {
+	keep;
+}
+redirect "boss@corp.test";
+`
+	patterns, unsupported, err := ConvertSieve(script)
+	if err != nil {
+		t.Fatalf("Error converting script: %v", err)
+	}
+	if len(patterns) != 4 {
+		t.Fatalf("Wrong number of patterns. want: 4, have: %d %v", len(patterns), patterns)
+	}
+	// else branch depends on unsupported size test too
+	if len(unsupported) != 3 || !strings.Contains(unsupported[0], "size") || !strings.Contains(unsupported[2], "redirect") {
+		t.Errorf("Wrong unsupported constructs: %v", unsupported)
+	}
+	for _, pattern := range patterns {
+		if err := pattern.Compile(); err != nil {
+			t.Errorf("Converted pattern %v is not valid: %v", pattern, err)
+		}
+	}
+
+	testCases := []tCase{
+		{"Weekly digest", "info@news.test", patterns[0]},
+		{"Deploy finished", "dev@corp.test", patterns[2]},
+		{"New release", "dev@corp.test", patterns[3]},
+		{"Deploy finished", "bot@ci.test", nil},
+		{"Lunch", "dev@corp.test", nil},
+	}
+	for i, testCase := range testCases {
+		msg := &imap.Message{Envelope: &imap.Envelope{Subject: testCase.Subject, From: []*imap.Address{parseTestAddress(testCase.From)}}}
+		var matched *NotifyPatterns
+		for _, pattern := range patterns {
+			if pattern.Match(msg) {
+				matched = pattern
+				break
+			}
+		}
+		if matched != testCase.Result {
+			t.Errorf("[%d] matched pattern mismatch. want: %v, have: %v", i, testCase.Result, matched)
+		}
+	}
+	if !patterns[0].Exclude || !patterns[1].Exclude || patterns[2].Exclude {
+		t.Errorf("Mute rules are not converted: %v", patterns)
+	}
+
+	for i, invalid := range []string{
+		`if header :contains "subject" "a" { keep; `,
+		`if header :contains "subject" "a" keep;`,
+		`if header :contains "subject" "a { keep; }`,
+		`if header :contains "subject" text:
+a
+.
+{ keep; }`,
+	} {
+		if _, _, err := ConvertSieve(invalid); err == nil {
+			t.Errorf("[%d] invalid script is accepted", i)
+		}
+	}
+}
+
+func parseTestAddress(email string) *imap.Address {
+	parts := strings.SplitN(email, "@", 2)
+	return &imap.Address{MailboxName: parts[0], HostName: parts[1]}
+}
+
+// fakeMessenger records messages sent to users instead of sending them to Telegram
+type fakeMessenger struct {
+	mu            sync.Mutex
+	lastMessageID int
+	sent          []tgbotapi.Chattable
+	deleted       []int
+	documents     []string
+	pinned        []int
+	unpinned      []int
+	callbacks     []string
+	sendErr       error
+}
+
+func (m *fakeMessenger) nextMessage(chatID int64) tgbotapi.Message {
+	m.lastMessageID += 1
+	return tgbotapi.Message{MessageID: m.lastMessageID, Chat: &tgbotapi.Chat{ID: chatID}}
+}
+
+func (m *fakeMessenger) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sendErr != nil {
+		return tgbotapi.Message{}, m.sendErr
+	}
+	m.sent = append(m.sent, c)
+	var chatID int64
+	if msg, ok := c.(tgbotapi.MessageConfig); ok {
+		chatID = msg.ChatID
+	}
+	return m.nextMessage(chatID), nil
+}
+
+func (m *fakeMessenger) DeleteMessage(config tgbotapi.DeleteMessageConfig) (tgbotapi.APIResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleted = append(m.deleted, config.MessageID)
+	return tgbotapi.APIResponse{Ok: true}, nil
+}
+
+func (m *fakeMessenger) AnswerCallbackQuery(config tgbotapi.CallbackConfig) (tgbotapi.APIResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.callbacks = append(m.callbacks, config.Text)
+	return tgbotapi.APIResponse{Ok: true}, nil
+}
+
+func (m *fakeMessenger) SendDocument(chatID int64, name string, data []byte) (tgbotapi.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.documents = append(m.documents, name)
+	return m.nextMessage(chatID), nil
+}
+
+func (m *fakeMessenger) PinChatMessage(config tgbotapi.PinChatMessageConfig) (tgbotapi.APIResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pinned = append(m.pinned, config.MessageID)
+	return tgbotapi.APIResponse{Ok: true}, nil
+}
+
+func (m *fakeMessenger) UnpinMessage(chatID int64, messageID int) (tgbotapi.APIResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unpinned = append(m.unpinned, messageID)
+	return tgbotapi.APIResponse{Ok: true}, nil
+}
+
+func (m *fakeMessenger) GetFileDirectURL(fileID string) (string, error) {
+	return "", fmt.Errorf("file %s is not found", fileID)
+}
+
+// texts returns texts of sent messages
+func (m *fakeMessenger) texts() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	texts := make([]string, 0, len(m.sent))
+	for _, c := range m.sent {
+		if msg, ok := c.(tgbotapi.MessageConfig); ok {
+			texts = append(texts, msg.Text)
+		}
+	}
+	return texts
+}
+
+// waitTexts waits until count messages are sent from background goroutines and returns their texts
+func (m *fakeMessenger) waitTexts(count int) []string {
+	deadline := time.Now().Add(time.Second)
+	for len(m.texts()) < count && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return m.texts()
+}
+
+// fakeMailbox is in-memory mail server. It is MailDialer of fakeMailSource connections.
+type fakeMailbox struct {
+	mu       sync.Mutex
+	folders  map[string]*fakeFolder
+	dialErr  error
+	loginErr error
+	uidPlus  bool
+}
+
+type fakeFolder struct {
+	attr        string
+	uidValidity uint32
+	lastUID     uint32
+	emails      []*fakeEmail
+}
+
+type fakeEmail struct {
+	uid      uint32
+	envelope *imap.Envelope
+	flags    []string
+	raw      string
+}
+
+func newFakeMailbox(folders ...string) *fakeMailbox {
+	box := &fakeMailbox{folders: make(map[string]*fakeFolder)}
+	for _, folder := range folders {
+		box.folders[folder] = &fakeFolder{uidValidity: 1}
+	}
+	return box
+}
+
+// newTestBoxHandler returns handler of active account test@test.com with id 1 connecting to box.
+// Its user has patterns and fakeMessenger.
+func newTestBoxHandler(t *testing.T, box *fakeMailbox, patterns ...*NotifyPatterns) *EmailBoxHandler {
+	t.Helper()
+	password, err := credentials.Seal("Test123")
+	if err != nil {
+		t.Fatalf("Error sealing password: %v", err)
+	}
+	user := &StoredUser{ChatID: 100500, Patterns: patterns, messenger: &fakeMessenger{}, mailDialer: box}
+	account := &StoredEmailAccount{id: 1, imapHost: "imap.test.com:993", login: "test@test.com", password: password, updateT: 3, isActive: true}
+	handler := NewEmailBoxHandler(account, user)
+	user.emailBoxHandlers = []*EmailBoxHandler{handler}
+	return handler
+}
+
+// deliver adds email to folder and returns its UID
+func (box *fakeMailbox) deliver(folder string, subject string, raw string) uint32 {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+	f := box.folders[folder]
+	f.lastUID += 1
+	envelope := &imap.Envelope{Subject: subject, From: []*imap.Address{parseTestAddress("sender@test.com")}}
+	f.emails = append(f.emails, &fakeEmail{uid: f.lastUID, envelope: envelope, raw: raw})
+	return f.lastUID
+}
+
+func (box *fakeMailbox) email(folder string, uid uint32) *fakeEmail {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+	for _, email := range box.folders[folder].emails {
+		if email.uid == uid {
+			return email
+		}
+	}
+	return nil
+}
+
+func (box *fakeMailbox) Dial(host string) (MailSource, error) {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+	if box.dialErr != nil {
+		return nil, box.dialErr
+	}
+	return &fakeMailSource{box: box, connected: true}, nil
+}
+
+// fakeMailSource is connection to fakeMailbox. Fetch items are ignored, all email data is returned.
+type fakeMailSource struct {
+	box       *fakeMailbox
+	connected bool
+}
+
+func (src *fakeMailSource) Login(login, password string) error {
+	return src.box.loginErr
+}
+
+func (src *fakeMailSource) Logout() error {
+	src.connected = false
+	return nil
+}
+
+func (src *fakeMailSource) Connected() bool {
+	return src.connected
+}
+
+func (src *fakeMailSource) folder(name string) (*fakeFolder, error) {
+	f, ok := src.box.folders[name]
+	if !ok {
+		return nil, fmt.Errorf("no such folder %s", name)
+	}
+	return f, nil
+}
+
+func (src *fakeMailSource) ListFolders() ([]*imap.MailboxInfo, error) {
+	src.box.mu.Lock()
+	defer src.box.mu.Unlock()
+	folders := make([]*imap.MailboxInfo, 0, len(src.box.folders))
+	for name := range src.box.folders {
+		info := &imap.MailboxInfo{Name: name}
+		if attr := src.box.folders[name].attr; attr != "" {
+			info.Attributes = []string{attr}
+		}
+		folders = append(folders, info)
+	}
+	return folders, nil
+}
+
+func (src *fakeMailSource) Status(folder string) (MailboxCursor, error) {
+	src.box.mu.Lock()
+	defer src.box.mu.Unlock()
+	f, err := src.folder(folder)
+	if err != nil {
+		return MailboxCursor{}, err
+	}
+	return MailboxCursor{UIDValidity: f.uidValidity, LastUID: f.lastUID}, nil
+}
+
+// fetch returns copies of emails accepted by filter
+func (src *fakeMailSource) fetch(folder string, filter func(i int, email *fakeEmail) bool) ([]*imap.Message, error) {
+	src.box.mu.Lock()
+	defer src.box.mu.Unlock()
+	f, err := src.folder(folder)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*imap.Message, 0)
+	for i, email := range f.emails {
+		if !filter(i, email) {
+			continue
+		}
+		msg := imap.NewMessage(uint32(i+1), nil)
+		msg.Uid = email.uid
+		msg.Envelope = email.envelope
+		msg.Flags = append([]string(nil), email.flags...)
+		msg.Body[&imap.BodySectionName{}] = bytes.NewBufferString(email.raw)
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+func (src *fakeMailSource) FetchSince(folder string, lastUID uint32, items []imap.FetchItem) ([]*imap.Message, error) {
+	return src.fetch(folder, func(i int, email *fakeEmail) bool { return email.uid > lastUID })
+}
+
+func (src *fakeMailSource) Fetch(folder string, uids []uint32, items []imap.FetchItem) ([]*imap.Message, error) {
+	return src.fetch(folder, func(i int, email *fakeEmail) bool {
+		for _, uid := range uids {
+			if email.uid == uid {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (src *fakeMailSource) FetchLast(folder string, count int, items []imap.FetchItem) ([]*imap.Message, error) {
+	src.box.mu.Lock()
+	total := 0
+	if f, ok := src.box.folders[folder]; ok {
+		total = len(f.emails)
+	}
+	src.box.mu.Unlock()
+	return src.fetch(folder, func(i int, email *fakeEmail) bool { return count <= 0 || i >= total-count })
+}
+
+func (src *fakeMailSource) AddFlags(folder string, uids []uint32, flags ...string) error {
+	messages, err := src.Fetch(folder, uids, nil)
+	if err != nil {
+		return err
+	}
+	src.box.mu.Lock()
+	defer src.box.mu.Unlock()
+	for _, msg := range messages {
+		for _, email := range src.box.folders[folder].emails {
+			if email.uid == msg.Uid {
+				email.flags = append(email.flags, flags...)
+			}
+		}
+	}
+	return nil
+}
+
+func (src *fakeMailSource) SupportsUIDExpunge() bool {
+	return src.box.uidPlus
+}
+
+func (src *fakeMailSource) Expunge(folder string, uids []uint32) error {
+	src.box.mu.Lock()
+	defer src.box.mu.Unlock()
+	f, err := src.folder(folder)
+	if err != nil {
+		return err
+	}
+	kept := make([]*fakeEmail, 0, len(f.emails))
+	for _, email := range f.emails {
+		deleted := false
+		for _, flag := range email.flags {
+			deleted = deleted || flag == imap.DeletedFlag
+		}
+		listed := false
+		for _, uid := range uids {
+			listed = listed || email.uid == uid
+		}
+		if !deleted || !listed {
+			kept = append(kept, email)
+		}
+	}
+	f.emails = kept
+	return nil
+}
+
+func (src *fakeMailSource) Move(folder string, uids []uint32, dest string) error {
+	src.box.mu.Lock()
+	defer src.box.mu.Unlock()
+	from, err := src.folder(folder)
+	if err != nil {
+		return err
+	}
+	to, err := src.folder(dest)
+	if err != nil {
+		return err
+	}
+	kept := make([]*fakeEmail, 0, len(from.emails))
+	for _, email := range from.emails {
+		moved := false
+		for _, uid := range uids {
+			moved = moved || email.uid == uid
+		}
+		if !moved {
+			kept = append(kept, email)
+			continue
+		}
+		to.lastUID += 1
+		movedEmail := *email
+		movedEmail.uid = to.lastUID
+		to.emails = append(to.emails, &movedEmail)
+	}
+	from.emails = kept
+	return nil
+}
+
+func TestAddingAccount(t *testing.T) {
+	messenger := &fakeMessenger{}
+
+	type tCase struct {
+		textMessages  []string
+		resultMsgText string //Must contain, not match
+	}
+	newAccount := StoredEmailAccount{
+		id:       0,
+		imapHost: "imap.test.com",
+		login:    "test@test.com",
+		password: "Test123",
+		updateT:  3,
+		isActive: false,
+	}
+
+	testCases := []tCase{
+		{
+			textMessages:  []string{AddAccount, "test"},
+			resultMsgText: "Wrong format for login, please set <login>@<domain>",
+		},
+		{
+			textMessages:  []string{AddAccount, newAccount.login, "localhost"},
+			resultMsgText: "Invalid hostname for imap server localhost",
+		},
+		{
+			textMessages:  []string{AddAccount, newAccount.login, "imap.test.com:rr"},
+			resultMsgText: "Invalid imap port in host",
+		},
+		{
+			textMessages:  []string{AddAccount, newAccount.login, newAccount.imapHost, newAccount.password, "1min"},
+			resultMsgText: "Invalid value for update frequency 1min",
+		},
+		{
+			textMessages:  []string{AddAccount, newAccount.login, newAccount.imapHost, newAccount.password, strconv.Itoa(newAccount.updateT)},
+			resultMsgText: "Account created",
+		},
+		{
+			textMessages:  []string{AddAccount, newAccount.login, newAccount.imapHost, newAccount.password, strconv.Itoa(newAccount.updateT), AddAccount, newAccount.login, newAccount.imapHost},
+			resultMsgText: "You already have account with this email for this host",
+		},
+	}
+	dialogHandler := UserDialogHandler{
+		lastCommand:     "",
+		lastSubCommand:  "",
+		chatID:          0,
+		newEmailAccount: nil,
+		commandFinished: false,
+	}
+	user := &StoredUser{messenger: messenger, mailDialer: newFakeMailbox(defaultFolder)}
+	for i, tCase := range testCases {
+		var lastMsgText string
+		for _, msgText := range tCase.textMessages {
+			inMsg := &tgbotapi.Message{
+				Text: msgText,
+			}
+			outMsg, _ := dialogHandler.AddEmailAccountHandler(inMsg, user)
+			lastMsgText = outMsg.Text
+		}
+		if !strings.Contains(lastMsgText, tCase.resultMsgText) {
+			t.Errorf("[%d] Text mismatch.\nWant: %s\nHave:%s", i, tCase.resultMsgText, lastMsgText)
+		}
+	}
+}
+
+func TestUserDialogHandler_ListAccountsHandler(t *testing.T) {
+	messenger := &fakeMessenger{}
+
+	type tCase struct {
+		textMessages  []string
+		resultMsgText string //Must contain, not match
+		inListStr     string
+	}
+	newAccount1 := StoredEmailAccount{
+		id:       0,
+		imapHost: "imap.test.com",
+		login:    "test@test.com",
+		password: "Test123",
+		updateT:  3,
+		isActive: false,
+	}
+	newAccount2 := StoredEmailAccount{
+		id:       0,
+		imapHost: "imap.test2.com",
+		login:    "test2@test2.com",
+		password: "Test123",
+		updateT:  7,
+		isActive: false,
+	}
+
+	addingAccountSteps := []tCase{
+		{
+			textMessages:  []string{AddAccount, newAccount1.login, newAccount1.imapHost, newAccount1.password, strconv.Itoa(newAccount1.updateT)},
+			resultMsgText: "Account created",
+			inListStr:     fmt.Sprintf("Login: %s, timeout: %d min, active: %t\n", newAccount1.login, newAccount1.updateT, true),
+		},
+		{
+			textMessages:  []string{AddAccount, newAccount2.login, newAccount2.imapHost, newAccount2.password, strconv.Itoa(newAccount2.updateT)},
+			resultMsgText: "Account created",
+			inListStr:     fmt.Sprintf("Login: %s, timeout: %d min, active: %t\n", newAccount2.login, newAccount2.updateT, true),
+		},
+	}
+
+	dialogHandler := UserDialogHandler{
+		lastCommand:     "",
+		lastSubCommand:  "",
+		chatID:          0,
+		newEmailAccount: nil,
+		commandFinished: false,
+	}
+	var listTotalStr string
+	var wantAccounts int
+	user := &StoredUser{messenger: messenger, mailDialer: newFakeMailbox(defaultFolder)}
+	for i, tCase := range addingAccountSteps {
+		var lastMsgText string
+		for _, msgText := range tCase.textMessages {
+			inMsg := &tgbotapi.Message{
+				Text: msgText,
+			}
+			outMsg, _ := dialogHandler.AddEmailAccountHandler(inMsg, user)
+			lastMsgText = outMsg.Text
+		}
+
+		if !strings.Contains(lastMsgText, tCase.resultMsgText) {
+			t.Errorf("[%d] Add Text mismatch.\nWant: %s\nHave:%s", i, tCase.resultMsgText, lastMsgText)
+			t.Fail()
+		}
+		listTotalStr += tCase.inListStr
+		wantAccounts += 1
+		wantTest := fmt.Sprintf("You have %d email accounts:\n", wantAccounts) + listTotalStr
+		listMsg, _ := dialogHandler.ListAccountsHandler(user)
+		if listMsg.Text != wantTest {
+			t.Errorf("[%d] List Text mismatch.\nWant: %s\nHave:%s", i, listTotalStr, listMsg.Text)
+			t.Fail()
+		}
+	}
+
+}
+
+func TestEmailBoxHandler_FetchNewEmails(t *testing.T) {
+	box := newFakeMailbox(defaultFolder)
+	box.deliver(defaultFolder, "Old invoice", "")
+	handler := newTestBoxHandler(t, box, &NotifyPatterns{ID: 1, Subject: "invoice", Priority: priorityUrgent})
+	account := handler.eAccount
+	messenger := handler.messenger.(*fakeMessenger)
+
+	type tCase struct {
+		prepare   func()
+		wantTexts []string //Sent messages must contain texts in the same order
+		wantLast  uint32
+	}
+	invoiceUID := uint32(0)
+	testCases := []tCase{
+		{
+			// First check only remembers position in folder
+			prepare:   func() {},
+			wantTexts: []string{"Successfully connected to mailbox for test@test.com"},
+			wantLast:  1,
+		},
+		{
+			prepare: func() {
+				invoiceUID = box.deliver(defaultFolder, "Invoice 42", "From: sender@test.com\r\nSubject: Invoice 42\r\n\r\nPlease pay")
+				box.deliver(defaultFolder, "Newsletter", "")
+			},
+			wantTexts: []string{"Invoice 42"},
+			wantLast:  3,
+		},
+		{
+			prepare:  func() { box.email(defaultFolder, invoiceUID).flags = []string{imap.SeenFlag} },
+			wantLast: 3,
+		},
+		{
+			// UIDs are reset by server, new emails are not notified until next check
+			prepare: func() {
+				box.folders[defaultFolder] = &fakeFolder{uidValidity: 2}
+				box.deliver(defaultFolder, "Invoice 43", "")
+			},
+			wantLast: 1,
+		},
+		{
+			prepare:   func() { box.dialErr = fmt.Errorf("connection refused") },
+			wantTexts: []string{"Error connecting to imap server: imap.test.com:993 after 3 retries"},
+			wantLast:  1,
+		},
+	}
+	for i, tCase := range testCases {
+		tCase.prepare()
+		sentBefore := len(messenger.texts())
+		for j := 0; j < 3; j++ {
+			handler.FetchNewEmails()
+			if box.dialErr == nil {
+				break
+			}
+		}
+		texts := messenger.texts()[sentBefore:]
+		if len(texts) != len(tCase.wantTexts) {
+			t.Errorf("[%d] Sent messages mismatch.\nWant: %v\nHave: %v", i, tCase.wantTexts, texts)
+			continue
+		}
+		for j, want := range tCase.wantTexts {
+			if !strings.Contains(texts[j], want) {
+				t.Errorf("[%d] Message text mismatch.\nWant: %s\nHave: %s", i, want, texts[j])
+			}
+		}
+		if cursor, _ := account.folderCursor(defaultFolder); cursor.LastUID != tCase.wantLast {
+			t.Errorf("[%d] Cursor mismatch. want: %d, have: %d", i, tCase.wantLast, cursor.LastUID)
+		}
+	}
+	if !reflect.DeepEqual(messenger.pinned, messenger.unpinned) || len(messenger.pinned) != 1 {
+		t.Errorf("Urgent notification is not unpinned after email is read. pinned: %v, unpinned: %v", messenger.pinned, messenger.unpinned)
+	}
+	if account.isActive {
+		t.Errorf("Account is active after connection retries failed")
+	}
+}
+
+func TestEmailBoxHandler_RequiresAckWithDigest(t *testing.T) {
+	box := newFakeMailbox(defaultFolder)
+	onCall := &NotifyPatterns{ID: 1, RequiresAck: true, Conditions: []*PatternCondition{
+		{Field: patternFieldSubject, Mode: matchContains, Value: "disk full"},
+	}}
+	other := &NotifyPatterns{ID: 2, Conditions: []*PatternCondition{
+		{Field: patternFieldSubject, Mode: matchContains, Value: "weekly"},
+	}}
+	handler := newTestBoxHandler(t, box, onCall, other)
+	handler.eAccount.digest = &DigestSchedule{IntervalMin: 60}
+	user := handler.user
+	messenger := handler.messenger.(*fakeMessenger)
+
+	handler.FetchNewEmails()
+	uid := box.deliver(defaultFolder, "Disk full on db1", "Subject: Disk full on db1\r\n\r\n95%")
+	box.deliver(defaultFolder, "Weekly report", "")
+	handler.FetchNewEmails()
+
+	texts := messenger.texts()
+	if len(texts) != 2 || !strings.Contains(texts[1], "Disk full on db1") {
+		t.Fatalf("Notification which requires acknowledgement is not sent immediately: %v", texts)
+	}
+	if uids := user.acks.folderUIDs(1, defaultFolder); !reflect.DeepEqual(uids, []uint32{uid}) {
+		t.Errorf("Notification is not waiting for acknowledgement: %v", uids)
+	}
+	if batches := user.digests.snapshot(); len(batches) != 1 || len(batches[0].Entries) != 1 ||
+		batches[0].Entries[0].Subject != "Weekly report" {
+		t.Errorf("Digest mismatch: %v", batches)
+	}
+}
+
+func TestEmailBoxHandler_RunEmailAction(t *testing.T) {
+	box := newFakeMailbox(defaultFolder, defaultArchiveFolder)
+	box.uidPlus = true
+	uid := box.deliver(defaultFolder, "Report", "")
+	handler := newTestBoxHandler(t, box)
+	ref := EmailRef{AccountID: 1, Folder: defaultFolder, UID: uid}
+
+	if text, err := handler.RunEmailAction(actionMarkRead, ref); err != nil || text != "Email marked as read" {
+		t.Errorf("Mark read failed: %s %v", text, err)
+	}
+	if email := box.email(defaultFolder, uid); !reflect.DeepEqual(email.flags, []string{imap.SeenFlag}) {
+		t.Errorf("Email is not marked as read: %v", email.flags)
+	}
+	if text, err := handler.RunEmailAction(actionArchive, ref); err != nil || text != "Email moved to Archive" {
+		t.Errorf("Archive failed: %s %v", text, err)
+	}
+	if box.email(defaultFolder, uid) != nil || box.email(defaultArchiveFolder, 1) == nil {
+		t.Errorf("Email is not moved to archive")
+	}
+	// Email marked deleted in other client must survive deletion of archived one
+	keptUID := box.deliver(defaultArchiveFolder, "Keep me", "")
+	box.email(defaultArchiveFolder, keptUID).flags = []string{imap.DeletedFlag}
+	archived := EmailRef{AccountID: 1, Folder: defaultArchiveFolder, UID: 1}
+	if text, err := handler.RunEmailAction(actionDelete, archived); err != nil || text != "Email deleted" {
+		t.Errorf("Delete failed: %s %v", text, err)
+	}
+	if box.email(defaultArchiveFolder, 1) != nil {
+		t.Errorf("Email is not deleted")
+	}
+	if box.email(defaultArchiveFolder, keptUID) == nil {
+		t.Errorf("Other email marked deleted is expunged")
+	}
+}
+
+func TestEmailBoxHandler_SendBrokenAttachments(t *testing.T) {
+	rawEmail := "From: Tester <test@mail.test>\r\n" +
+		"Subject: Invoice\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/csv\r\n" +
+		"Content-Disposition: attachment; filename=\"report.csv\"\r\n" +
+		"\r\n" +
+		"a,b\r\n" +
+		"--b1\r\n" +
+		"Broken header\r\n" +
+		"\r\n" +
+		"c,d\r\n" +
+		"--b1--\r\n"
+	box := newFakeMailbox(defaultFolder)
+	uid := box.deliver(defaultFolder, "Invoice", rawEmail)
+	handler := newTestBoxHandler(t, box)
+	messenger := handler.messenger.(*fakeMessenger)
+
+	text, err := handler.RunEmailAction(actionAttachments, EmailRef{AccountID: 1, Folder: defaultFolder, UID: uid})
+	if err != nil {
+		t.Fatalf("Error sending attachments: %v", err)
+	}
+	if !strings.HasPrefix(text, "Sent 1 attachments\nSkipped:\nrest of email (") {
+		t.Errorf("Parsing error is not reported: %q", text)
+	}
+	if !reflect.DeepEqual(messenger.documents, []string{"report.csv"}) {
+		t.Errorf("Documents mismatch: %v", messenger.documents)
+	}
+}
+
+func TestUserDialogHandler_EmailActionCallback(t *testing.T) {
+	box := newFakeMailbox(defaultFolder)
+	uid := box.deliver(defaultFolder, "Report", "")
+	handler := newTestBoxHandler(t, box)
+	user := handler.user
+	messenger := handler.messenger.(*fakeMessenger)
+
+	data, _ := encodeEmailAction(actionMarkRead, EmailRef{AccountID: 1, Folder: defaultFolder, UID: uid})
+	if msg, err := (&UserDialogHandler{}).EmailActionCallback(data, user); msg != nil || err != nil {
+		t.Errorf("Action result is returned to update loop: %v %v", msg, err)
+	}
+	if texts := messenger.waitTexts(1); !reflect.DeepEqual(texts, []string{"Email marked as read"}) {
+		t.Errorf("Action result is not sent to user: %v", texts)
+	}
+}
+
+func TestUserDialogHandler_ReplyToEmailHandler(t *testing.T) {
+	// SMTP server refuses connections
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error reserving port: %v", err)
+	}
+	smtpHost := listener.Addr().String()
+	listener.Close()
+
+	box := newFakeMailbox(defaultFolder)
+	uid := box.deliver(defaultFolder, "Question", "")
+	handler := newTestBoxHandler(t, box)
+	handler.eAccount.smtpHost, handler.eAccount.smtpSecurity = smtpHost, smtpSecurityStartTLS
+	user := handler.user
+	user.LastMessageId = 42
+	messenger := handler.messenger.(*fakeMessenger)
+
+	ref := EmailRef{AccountID: 1, Folder: defaultFolder, UID: uid}
+	if msg, err := (&UserDialogHandler{}).ReplyToEmailHandler("Sure", ref, user); msg != nil || err != nil {
+		t.Errorf("Reply is sent in update loop: %v %v", msg, err)
+	}
+	if texts := messenger.waitTexts(1); len(texts) != 1 || !strings.HasPrefix(texts[0], "Error sending reply: ") {
+		t.Fatalf("Reply result is not sent: %v", texts)
+	}
+	if msg := messenger.sent[0].(tgbotapi.MessageConfig); msg.ReplyToMessageID != 42 {
+		t.Errorf("Reply result is not sent as reply to user's message: %d", msg.ReplyToMessageID)
+	}
+}
+
+func TestUserDialogHandler_ChangeFolders(t *testing.T) {
+	box := newFakeMailbox(defaultFolder, "Alerts")
+	handler := newTestBoxHandler(t, box)
+	user := handler.user
+	messenger := handler.messenger.(*fakeMessenger)
+	h := &UserDialogHandler{newEmailAccount: handler.eAccount}
+
+	user.mu.Lock()
+	msg, err := h.ChangeAccountCommandsH("chfolders", user)
+	user.mu.Unlock()
+	if msg != nil || err != nil {
+		t.Errorf("Folders are listed in update loop: %v %v", msg, err)
+	}
+	if texts := messenger.waitTexts(1); len(texts) != 1 || !strings.HasPrefix(texts[0], "Monitored folders: INBOX") {
+		t.Fatalf("Folders picker is not sent: %v", texts)
+	}
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	if !reflect.DeepEqual(h.folderChoices, []string{"Alerts", defaultFolder}) {
+		t.Errorf("Folder choices mismatch: %v", h.folderChoices)
+	}
+}
+
+func TestUserDialogHandler_TestPatternHandler(t *testing.T) {
+	box := newFakeMailbox(defaultFolder)
+	box.deliver(defaultFolder, "Invoice 42", "")
+	box.deliver(defaultFolder, "Weekly news", "")
+	handler := newTestBoxHandler(t, box)
+	user := handler.user
+	messenger := handler.messenger.(*fakeMessenger)
+	h := &UserDialogHandler{conditionIndex: -1, newPattern: &NotifyPatterns{ID: 1, Conditions: []*PatternCondition{
+		{Field: patternFieldSubject, Mode: matchContains, Value: "invoice"},
+	}}}
+
+	user.mu.Lock()
+	msg, err := h.TestPatternHandler(user)
+	user.mu.Unlock()
+	if msg != nil || err != nil {
+		t.Errorf("Pattern is tested in update loop: %v %v", msg, err)
+	}
+	texts := messenger.waitTexts(1)
+	if len(texts) != 1 || !strings.Contains(texts[0], "test@test.com: 1 of 2 last emails match") {
+		t.Errorf("Test result is not sent: %v", texts)
+	}
+}
+
+func TestEmailBoxHandler_DeleteWithoutUIDPlus(t *testing.T) {
+	box := newFakeMailbox(defaultFolder, "Bin")
+	box.folders["Bin"].attr = imap.TrashAttr
+	uid := box.deliver(defaultFolder, "Spam", "")
+	keptUID := box.deliver(defaultFolder, "Keep me", "")
+	box.email(defaultFolder, keptUID).flags = []string{imap.DeletedFlag}
+	handler := newTestBoxHandler(t, box)
+
+	type tCase struct {
+		ref      EmailRef
+		wantText string
+	}
+	testCases := []tCase{
+		{EmailRef{AccountID: 1, Folder: defaultFolder, UID: uid}, "Email moved to Bin"},
+		{EmailRef{AccountID: 1, Folder: "Bin", UID: 1}, "Email marked as deleted"},
+	}
+	for i, tCase := range testCases {
+		if text, err := handler.RunEmailAction(actionDelete, tCase.ref); err != nil || text != tCase.wantText {
+			t.Errorf("[%d] Delete result mismatch. want: %s, have: %s %v", i, tCase.wantText, text, err)
+		}
+	}
+	if box.email(defaultFolder, uid) != nil || box.email(defaultFolder, keptUID) == nil {
+		t.Errorf("Only deleted email must be moved to trash")
+	}
+	if email := box.email("Bin", 1); email == nil || !reflect.DeepEqual(email.flags, []string{imap.DeletedFlag}) {
+		t.Errorf("Email in trash is not marked deleted: %v", email)
+	}
+}
+
+func TestBoltStorage_SaveLoadUser(t *testing.T) {
+	storage, err := NewBoltStorage(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Error opening storage: %v", err)
+	}
+	defer storage.Close()
+
+	user := &StoredUser{
+		ID:       42,
+		Login:    "tester",
+		ChatID:   100500,
+		Patterns: []*NotifyPatterns{{ID: 1, Subject: "important"}},
+		storage:  storage,
+	}
+	accounts := []*StoredEmailAccount{
+		{id: 1, imapHost: "imap.test.com:993", login: "test@test.com", password: "Test123", updateT: 3, isActive: false},
+		{id: 2, imapHost: "imap.test2.com:993", login: "test2@test2.com", password: "Test321", updateT: 7, isActive: false,
+			pushMode: true, folders: []string{"INBOX", "Alerts"},
+			cursors: map[string]MailboxCursor{"INBOX": {UIDValidity: 1, LastUID: 10}, "Alerts": {UIDValidity: 5, LastUID: 3}}},
+	}
+	for _, account := range accounts {
+		user.emailBoxHandlers = append(user.emailBoxHandlers, NewEmailBoxHandler(account, user))
+	}
+	user.Save()
+
+	users, err := storage.LoadUsers()
+	if err != nil {
+		t.Fatalf("Error loading users: %v", err)
+	}
+	if len(users) != 1 {
+		t.Fatalf("Users count mismatch. want: 1, have: %d", len(users))
+	}
+	loaded := users[0]
+	if loaded.ID != user.ID || loaded.Login != user.Login || loaded.ChatID != user.ChatID {
+		t.Errorf("User mismatch.\nWant: %+v\nHave: %+v", user, loaded)
+	}
+	if len(loaded.Patterns) != 1 || loaded.Patterns[0].Subject != "important" {
+		t.Errorf("Patterns mismatch: %+v", loaded.Patterns)
+	}
+	if len(loaded.emailBoxHandlers) != len(accounts) {
+		t.Fatalf("Accounts count mismatch. want: %d, have: %d", len(accounts), len(loaded.emailBoxHandlers))
+	}
+	for i, boxHandler := range loaded.emailBoxHandlers {
+		want, have := accounts[i], boxHandler.eAccount
+		if want.id != have.id || want.imapHost != have.imapHost || want.login != have.login ||
+			want.password != have.password || want.updateT != have.updateT ||
+			want.isActive != have.isActive || want.pushMode != have.pushMode {
+			t.Errorf("[%d] Account mismatch.\nWant: %+v\nHave: %+v", i, want, have)
+		}
+		if !reflect.DeepEqual(want.monitoredFolders(), have.monitoredFolders()) {
+			t.Errorf("[%d] Folders mismatch. want: %v, have: %v", i, want.monitoredFolders(), have.monitoredFolders())
+		}
+		if !reflect.DeepEqual(want.folderCursors(), have.folderCursors()) {
+			t.Errorf("[%d] Cursors mismatch. want: %v, have: %v", i, want.folderCursors(), have.folderCursors())
+		}
+		if boxHandler.user != loaded {
+			t.Errorf("[%d] Box handler is not bound to loaded user", i)
+		}
+	}
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	storage, err := NewBoltStorage(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Error opening storage: %v", err)
+	}
+	defer storage.Close()
+
+	oldCipher, _ := NewCredentialCipher("old key")
+	newCipher, _ := NewCredentialCipher("new key")
+	passwords := []string{"Test123", "Test321"}
+	user := &StoredUser{ID: 1, storage: storage}
+	for i, password := range passwords {
+		sealed, err := oldCipher.Seal(password)
+		if err != nil {
+			t.Fatalf("[%d] Error sealing password: %v", i, err)
+		}
+		if sealed == password {
+			t.Errorf("[%d] Password is not encrypted", i)
+		}
+		account := &StoredEmailAccount{id: i, login: fmt.Sprintf("test%d@test.com", i), password: sealed}
+		user.emailBoxHandlers = append(user.emailBoxHandlers, NewEmailBoxHandler(account, user))
+	}
+	user.Save()
+
+	if _, err := RotateMasterKey(storage, newCipher, oldCipher); err == nil {
+		t.Errorf("Rotation with wrong old key must fail")
+	}
+	rotated, err := RotateMasterKey(storage, oldCipher, newCipher)
+	if err != nil {
+		t.Fatalf("Error rotating key: %v", err)
+	}
+	if rotated != len(passwords) {
+		t.Errorf("Rotated accounts mismatch. want: %d, have: %d", len(passwords), rotated)
+	}
+
+	users, _ := storage.LoadUsers()
+	for i, boxHandler := range users[0].emailBoxHandlers {
+		if _, err := oldCipher.Open(boxHandler.eAccount.password); err == nil {
+			t.Errorf("[%d] Password still opens with old key", i)
+		}
+		password, err := newCipher.Open(boxHandler.eAccount.password)
+		if err != nil || password != passwords[i] {
+			t.Errorf("[%d] Password mismatch. want: %s, have: %s (%v)", i, passwords[i], password, err)
+		}
+	}
+}
+
+func TestEmailNotification_ParseBody(t *testing.T) {
+	rawEmail := "From: Tester <test@mail.test>\r\n" +
+		"Subject: Report\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"b2\"\r\n" +
+		"\r\n" +
+		"--b2\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		"<p>Html &amp; text</p>\r\n" +
+		"--b2--\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/csv\r\n" +
+		"Content-Disposition: attachment; filename=\"report.csv\"\r\n" +
+		"\r\n" +
+		"a,b\r\n" +
+		"--b1--\r\n"
+
+	notification := &EmailNotification{}
+	if err := notification.ParseBody(strings.NewReader(rawEmail)); err != nil {
+		t.Fatalf("Error parsing body: %v", err)
+	}
+	if notification.Preview != "Html & text" {
+		t.Errorf("Preview mismatch. want: %q, have: %q", "Html & text", notification.Preview)
+	}
+	if !reflect.DeepEqual(notification.Attachments, []string{"report.csv"}) {
+		t.Errorf("Attachments mismatch: %v", notification.Attachments)
+	}
+}
+
+func TestExtractAttachments(t *testing.T) {
+	rawEmail := "From: Tester <test@mail.test>\r\n" +
+		"Subject: Invoice\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"Invoice attached\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-Disposition: attachment; filename=\"invoice.pdf\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"JVBERi0xLjQ=\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/csv\r\n" +
+		"Content-Disposition: attachment\r\n" +
+		"\r\n" +
+		"a,b\r\n" +
+		"--b1--\r\n"
+
+	attachments, skipped, err := ExtractAttachments(strings.NewReader(rawEmail))
+	if err != nil {
+		t.Fatalf("Error extracting attachments: %v", err)
+	}
+	if len(skipped) != 0 {
+		t.Errorf("Unexpected skipped attachments: %v", skipped)
+	}
+	want := []*EmailAttachment{
+		{Name: "invoice.pdf", Data: []byte("%PDF-1.4")},
+		{Name: "unnamed", Data: []byte("a,b")},
+	}
+	if !reflect.DeepEqual(attachments, want) {
+		for i, a := range attachments {
+			t.Errorf("[%d] have attachment %q: %q", i, a.Name, a.Data)
+		}
+	}
+}
+
+func TestEmailNotification_Format(t *testing.T) {
+	defaultPreviewLength := *PreviewLength
+	*PreviewLength = 5000
+	defer func() { *PreviewLength = defaultPreviewLength }()
+
+	notification := &EmailNotification{
+		Account: "test@mail.test",
+		Folder:  "INBOX",
+		Envelope: &imap.Envelope{
+			Subject: "Build <failed> & stopped",
+			From:    []*imap.Address{{PersonalName: "CI", MailboxName: "ci", HostName: "corp.test"}},
+			To:      []*imap.Address{{MailboxName: "dev", HostName: "corp.test"}},
+		},
+		Attachments: []string{"log.txt"},
+		Preview:     strings.Repeat("<x>", 3000),
+	}
+	text := notification.Format()
+	for _, want := range []string{
+		"Build &lt;failed&gt; &amp; stopped",
+		"CI &lt;ci@corp.test&gt;",
+		"dev@corp.test",
+		"Attachments (1):</b> log.txt",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Notification doesn't contain %q:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, "<x>") {
+		t.Errorf("Preview is not escaped")
+	}
+	if l := len([]rune(text)); l > telegramMessageLimit {
+		t.Errorf("Notification is too long: %d", l)
+	}
+}
+
+func TestEmailActionCallbackData(t *testing.T) {
+	type tCase struct {
+		ref    EmailRef
+		fitsOk bool
+	}
+	testCases := []tCase{
+		{ref: EmailRef{AccountID: 1600000000, Folder: "INBOX", UID: 4294967295}, fitsOk: true},
+		{ref: EmailRef{AccountID: 1600000000, Folder: "Alerts:Prod/Errors", UID: 17}, fitsOk: true},
+		{ref: EmailRef{AccountID: 1600000000, Folder: strings.Repeat("f", 60), UID: 17}, fitsOk: false},
+	}
+	for i, tCase := range testCases {
+		data, ok := encodeEmailAction(actionArchive, tCase.ref)
+		if ok != tCase.fitsOk {
+			t.Errorf("[%d] fits mismatch. want: %t, have: %t", i, tCase.fitsOk, ok)
+		}
+		action, ref, err := parseEmailAction(data)
+		if err != nil {
+			t.Errorf("[%d] Error parsing %s: %v", i, data, err)
+			continue
+		}
+		if action != actionArchive || ref != tCase.ref {
+			t.Errorf("[%d] Ref mismatch.\nWant: %+v\nHave: %+v", i, tCase.ref, ref)
+		}
+	}
+	if _, _, err := parseEmailAction(emailActionPrefix + "rd:zz"); err == nil {
+		t.Errorf("Parsing broken callback data must fail")
+	}
+}
+
+func TestComposeReply(t *testing.T) {
+	original := &imap.Envelope{
+		Subject:   "Build failed",
+		MessageId: "<build-42@ci.corp.test>",
+		From:      []*imap.Address{{PersonalName: "CI", MailboxName: "ci", HostName: "corp.test"}},
+		ReplyTo:   []*imap.Address{{PersonalName: "Dev team", MailboxName: "dev", HostName: "corp.test"}},
+	}
+	from := &mail.Address{Address: "me@corp.test"}
+	reply, recipients, err := composeReply(from, original, []string{"build-41@ci.corp.test"}, "Looking into it\nwill fix")
+	if err != nil {
+		t.Fatalf("Error composing reply: %v", err)
+	}
+	if !reflect.DeepEqual(recipients, []string{"dev@corp.test"}) {
+		t.Errorf("Recipients mismatch: %v", recipients)
+	}
+
+	mr, err := mail.CreateReader(bytes.NewReader(reply))
+	if err != nil {
+		t.Fatalf("Error reading reply: %v", err)
+	}
+	if subject, _ := mr.Header.Subject(); subject != "Re: Build failed" {
+		t.Errorf("Subject mismatch: %s", subject)
+	}
+	if inReplyTo, _ := mr.Header.MsgIDList("In-Reply-To"); !reflect.DeepEqual(inReplyTo, []string{"build-42@ci.corp.test"}) {
+		t.Errorf("In-Reply-To mismatch: %v", inReplyTo)
+	}
+	wantRefs := []string{"build-41@ci.corp.test", "build-42@ci.corp.test"}
+	if refs, _ := mr.Header.MsgIDList("References"); !reflect.DeepEqual(refs, wantRefs) {
+		t.Errorf("References mismatch. want: %v, have: %v", wantRefs, refs)
+	}
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("Error reading reply body: %v", err)
+	}
+	body, _ := ioutil.ReadAll(part.Body)
+	if string(body) != "Looking into it\r\nwill fix" {
+		t.Errorf("Body mismatch: %q", body)
+	}
+
+	original.Subject = "RE: Build failed"
+	reply, _, _ = composeReply(from, original, nil, "ok")
+	mr, _ = mail.CreateReader(bytes.NewReader(reply))
+	if subject, _ := mr.Header.Subject(); subject != "RE: Build failed" {
+		t.Errorf("Subject must not be prefixed twice: %s", subject)
+	}
 }
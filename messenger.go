@@ -0,0 +1,42 @@
+package main
+
+import (
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"net/url"
+	"strconv"
+)
+
+// Messenger sends messages to users and manages sent messages. Dialog handlers and email box handlers
+// use it instead of Telegram client, so they can be tested with fake messenger.
+type Messenger interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	DeleteMessage(config tgbotapi.DeleteMessageConfig) (tgbotapi.APIResponse, error)
+	AnswerCallbackQuery(config tgbotapi.CallbackConfig) (tgbotapi.APIResponse, error)
+	SendDocument(chatID int64, name string, data []byte) (tgbotapi.Message, error)
+	PinChatMessage(config tgbotapi.PinChatMessageConfig) (tgbotapi.APIResponse, error)
+	UnpinMessage(chatID int64, messageID int) (tgbotapi.APIResponse, error)
+	GetFileDirectURL(fileID string) (string, error)
+}
+
+// TelegramMessenger is Messenger implementation with Telegram Bot API
+type TelegramMessenger struct {
+	*tgbotapi.BotAPI
+}
+
+// NewTelegramMessenger wraps Telegram Bot API client
+func NewTelegramMessenger(botAPI *tgbotapi.BotAPI) *TelegramMessenger {
+	return &TelegramMessenger{BotAPI: botAPI}
+}
+
+// SendDocument uploads file to chat
+func (m *TelegramMessenger) SendDocument(chatID int64, name string, data []byte) (tgbotapi.Message, error) {
+	return m.Send(tgbotapi.NewDocumentUpload(chatID, tgbotapi.FileBytes{Name: name, Bytes: data}))
+}
+
+// UnpinMessage unpins message by id. UnpinChatMessageConfig of Telegram library can unpin only last pinned message.
+func (m *TelegramMessenger) UnpinMessage(chatID int64, messageID int) (tgbotapi.APIResponse, error) {
+	params := url.Values{}
+	params.Add("chat_id", strconv.FormatInt(chatID, 10))
+	params.Add("message_id", strconv.Itoa(messageID))
+	return m.MakeRequest("unpinChatMessage", params)
+}
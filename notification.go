@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+	"html"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var PreviewLength = flag.Int("previewlen", 300, "Number of body characters shown in email notification")
+
+const (
+	telegramMessageLimit = 4096
+	headerValueLimit     = 256
+	addressListLimit     = 5
+	maxPreviewBodySize   = 1 << 20 //Read at most 1 MB of text part for preview
+)
+
+var (
+	htmlTagsRegexp    = regexp.MustCompile(`(?s)<(script|style)[^>]*>.*?</(script|style)>|<[^>]*>`)
+	blankLinesRegexp  = regexp.MustCompile(`\n\s*\n+`)
+	telegramEscaper   = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	bodySectionToPeek = &imap.BodySectionName{Peek: true}
+)
+
+// EmailNotification contains email data which is sent to user in notification
+type EmailNotification struct {
+	AccountID   int
+	Account     string
+	Folder      string
+	UID         uint32
+	Envelope    *imap.Envelope
+	Preview     string
+	Attachments []string
+	Silent      bool   //Sent without sound
+	Priority    string //Priority of matched pattern
+	RequiresAck bool   //User is reminded about email until acknowledges or reads it
+	Reminder    int    //Number of reminder for unacknowledged urgent notification, 0 for first notification
+}
+
+func (n *EmailNotification) ref() EmailRef {
+	return EmailRef{AccountID: n.AccountID, Folder: n.Folder, UID: n.UID}
+}
+
+// ParseBody reads email body, fills text preview and attachments list. If body is broken or cut
+// preview is filled with text read before error.
+func (n *EmailNotification) ParseBody(r io.Reader) error {
+	mr, err := mail.CreateReader(r)
+	if err != nil && !message.IsUnknownCharset(err) {
+		return err
+	}
+	plainText := ""
+	htmlText := ""
+	var partErr error
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil && !message.IsUnknownCharset(err) {
+			partErr = err
+			break
+		}
+		switch h := part.Header.(type) {
+		case *mail.InlineHeader:
+			contentType, _, _ := h.ContentType()
+			if contentType != "text/plain" && contentType != "text/html" {
+				continue
+			}
+			body, err := ioutil.ReadAll(io.LimitReader(part.Body, maxPreviewBodySize))
+			if err != nil && !message.IsUnknownCharset(err) {
+				partErr = err
+			}
+			if contentType == "text/plain" && plainText == "" {
+				plainText = string(body)
+			}
+			if contentType == "text/html" && htmlText == "" {
+				htmlText = string(body)
+			}
+		case *mail.AttachmentHeader:
+			filename, _ := h.Filename()
+			if filename == "" {
+				filename = "unnamed"
+			}
+			n.Attachments = append(n.Attachments, filename)
+		}
+	}
+	if plainText == "" && htmlText != "" {
+		plainText = stripHTML(htmlText)
+	}
+	n.Preview = strings.TrimSpace(blankLinesRegexp.ReplaceAllString(strings.ReplaceAll(plainText, "\r\n", "\n"), "\n\n"))
+	return partErr
+}
+
+// Format returns notification text with HTML markup for Telegram. Text is cut to fit Telegram message limit.
+func (n *EmailNotification) Format() string {
+	text := fmt.Sprintf("<b>New email</b> in %s / %s\n", escapeTelegram(n.Account), escapeTelegram(n.Folder))
+	if n.Priority == priorityUrgent {
+		marker := "🚨 <b>URGENT</b>"
+		if n.Reminder > 0 {
+			marker += fmt.Sprintf(" (reminder %d, not acknowledged)", n.Reminder)
+		}
+		text = marker + "\n" + text
+	} else if n.Reminder > 0 {
+		text = fmt.Sprintf("🔔 <b>Reminder %d</b>, not acknowledged\n", n.Reminder) + text
+	}
+	if n.Envelope != nil {
+		if !n.Envelope.Date.IsZero() {
+			text += fmt.Sprintf("<b>At:</b> %s\n", n.Envelope.Date.Format("2006-01-02 15:04:05"))
+		}
+		text += fmt.Sprintf("<b>From:</b> %s\n", formatAddressList(n.Envelope.From))
+		text += fmt.Sprintf("<b>To:</b> %s\n", formatAddressList(n.Envelope.To))
+		if len(n.Envelope.Cc) > 0 {
+			text += fmt.Sprintf("<b>Cc:</b> %s\n", formatAddressList(n.Envelope.Cc))
+		}
+		text += fmt.Sprintf("<b>Subject:</b> %s\n", escapeTelegram(truncateRunes(n.Envelope.Subject, headerValueLimit)))
+	}
+	if len(n.Attachments) > 0 {
+		text += fmt.Sprintf("📎 <b>Attachments (%d):</b> %s\n", len(n.Attachments),
+			escapeTelegram(truncateRunes(strings.Join(n.Attachments, ", "), headerValueLimit)))
+	}
+
+	previewLen := *PreviewLength
+	if n.Preview == "" || previewLen <= 0 {
+		return text
+	}
+	// Escaping makes preview longer, so cut raw text until escaped message fits into limit
+	for previewLen > 0 {
+		preview := truncateRunes(n.Preview, previewLen)
+		result := text + "\n<i>" + escapeTelegram(preview) + "</i>"
+		overflow := utf8.RuneCountInString(result) - telegramMessageLimit
+		if overflow <= 0 {
+			return result
+		}
+		previewLen = utf8.RuneCountInString(preview) - overflow - 1
+	}
+	return text
+}
+
+func formatAddress(addr *imap.Address) string {
+	email := addressEmail(addr)
+	if addr.PersonalName == "" {
+		return escapeTelegram(email)
+	}
+	return escapeTelegram(truncateRunes(addr.PersonalName, headerValueLimit)) + " &lt;" + escapeTelegram(email) + "&gt;"
+}
+
+func formatAddressList(addrs []*imap.Address) string {
+	formatted := make([]string, 0, addressListLimit+1)
+	for i, addr := range addrs {
+		if i == addressListLimit {
+			formatted = append(formatted, fmt.Sprintf("and %d more", len(addrs)-addressListLimit))
+			break
+		}
+		formatted = append(formatted, formatAddress(addr))
+	}
+	if len(formatted) == 0 {
+		return "-"
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// escapeTelegram escapes characters reserved by Telegram HTML parse mode
+func escapeTelegram(s string) string {
+	return telegramEscaper.Replace(s)
+}
+
+func stripHTML(s string) string {
+	s = strings.NewReplacer("<br>", "\n", "<br/>", "\n", "<br />", "\n", "</p>", "\n", "</div>", "\n").Replace(s)
+	return html.UnescapeString(htmlTagsRegexp.ReplaceAllString(s, ""))
+}
+
+// truncateRunes cuts string to limit characters adding ellipsis if string was cut
+func truncateRunes(s string, limit int) string {
+	if utf8.RuneCountInString(s) <= limit {
+		return s
+	}
+	if limit <= 1 {
+		return "…"
+	}
+	runes := []rune(s)
+	return string(runes[:limit-1]) + "…"
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/emersion/go-imap"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"log"
+	"strings"
+)
+
+var PatternTestCount = flag.Int("testcount", 50, "Number of last emails in every folder checked when testing pattern")
+
+// patternTestListLimit is how many matched emails of every account are listed in test results
+const patternTestListLimit = 10
+
+// PatternTestMatch is email matched by tested pattern
+type PatternTestMatch struct {
+	Folder   string
+	Envelope *imap.Envelope
+	Muted    bool //Email matches pattern but user wouldn't be notified because of mute rule
+}
+
+// TestPattern checks pattern on last emails of all monitored folders. Emails are not changed on server.
+// Returns matched emails and number of checked emails. Patterns are read under user lock, so pattern
+// could be changed by dialog while emails are fetched.
+func (handler *EmailBoxHandler) TestPattern(pattern *NotifyPatterns, count int) ([]*PatternTestMatch, int, error) {
+	src, err := handler.Dial()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer src.Logout()
+
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}
+	handler.user.mu.Lock()
+	items = append(items, patternsFetchItems(append(handler.accountPatterns(), pattern))...)
+	handler.user.mu.Unlock()
+	matches := make([]*PatternTestMatch, 0)
+	checked := 0
+	for _, folder := range handler.eAccount.monitoredFolders() {
+		messages, err := src.FetchLast(folder, count, items)
+		handler.user.mu.Lock()
+		for _, msg := range messages {
+			checked += 1
+			matched, muted := handler.testPatternMessage(pattern, msg)
+			if matched {
+				matches = append(matches, &PatternTestMatch{Folder: folder, Envelope: msg.Envelope, Muted: muted})
+			}
+		}
+		handler.user.mu.Unlock()
+		if err != nil {
+			return matches, checked, err
+		}
+	}
+	return matches, checked, nil
+}
+
+// testPatternMessage checks email with pattern. Mute rules of account are applied to emails matching
+// notification pattern in the same way as in CheckPatterns.
+func (handler *EmailBoxHandler) testPatternMessage(pattern *NotifyPatterns, msg *imap.Message) (bool, bool) {
+	ctx := newMatchContext(msg)
+	if !pattern.match(ctx) {
+		return false, false
+	}
+	if pattern.Exclude {
+		return true, false
+	}
+	for _, uPattern := range handler.accountPatterns() {
+		if uPattern.Exclude && uPattern.ID != pattern.ID && uPattern.match(ctx) {
+			return true, true
+		}
+	}
+	return true, false
+}
+
+// TestPatternHandler checks new pattern on last emails of accounts which pattern is applied to
+// and shows matched emails before pattern is saved. Test connects to IMAP servers, so it runs in background
+// and result is sent to user when all accounts are checked.
+func (h *UserDialogHandler) TestPatternHandler(user *StoredUser) (*tgbotapi.MessageConfig, error) {
+	pattern := h.newPattern
+	boxHandlers := make([]*EmailBoxHandler, 0, len(user.emailBoxHandlers))
+	for _, boxHandler := range user.emailBoxHandlers {
+		if pattern.appliesTo(boxHandler.eAccount.id) {
+			boxHandlers = append(boxHandlers, boxHandler)
+		}
+	}
+	go h.sendPatternTestResult(pattern, boxHandlers, user)
+	return nil, nil
+}
+
+// sendPatternTestResult tests pattern on accounts and sends result with pattern confirmation keyboard
+// if user still edits the same pattern
+func (h *UserDialogHandler) sendPatternTestResult(pattern *NotifyPatterns, boxHandlers []*EmailBoxHandler, user *StoredUser) {
+	resultText := ""
+	for _, boxHandler := range boxHandlers {
+		matches, checked, err := boxHandler.TestPattern(pattern, *PatternTestCount)
+		if err != nil {
+			resultText += fmt.Sprintf("\n%s: error checking emails. %v\n", boxHandler.eAccount.login, err)
+			continue
+		}
+		verb := "match"
+		if pattern.Exclude {
+			verb = "would be muted"
+		}
+		resultText += fmt.Sprintf("\n%s: %d of %d last emails %s\n", boxHandler.eAccount.login, len(matches), checked, verb)
+		for i := len(matches) - 1; i >= 0; i-- {
+			if len(matches)-i > patternTestListLimit {
+				resultText += fmt.Sprintf("and %d more\n", i+1)
+				break
+			}
+			resultText += formatPatternTestMatch(matches[i]) + "\n"
+		}
+	}
+	if len(boxHandlers) == 0 {
+		resultText += "\nNo accounts to test pattern on\n"
+	}
+
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	if h.newPattern != pattern {
+		return
+	}
+	resultText = "Test of " + pattern.String() + "\n" + resultText
+	rMsg := h.newPatternConfirmMessage(user)
+	rMsg.Text = truncateRunes(resultText, telegramMessageLimit/2) + "\n" + rMsg.Text
+	if _, err := user.messenger.Send(*rMsg); err != nil {
+		log.Println("Error sending message to user. ", err)
+	}
+}
+
+func formatPatternTestMatch(match *PatternTestMatch) string {
+	text := "• " + match.Folder
+	if match.Envelope != nil {
+		from := make([]string, 0, len(match.Envelope.From))
+		for _, addr := range match.Envelope.From {
+			from = append(from, addressEmail(addr))
+		}
+		if !match.Envelope.Date.IsZero() {
+			text += " " + match.Envelope.Date.Format("2006-01-02 15:04")
+		}
+		text += " " + strings.Join(from, ", ") + ": " + truncateRunes(match.Envelope.Subject, 80)
+	}
+	if match.Muted {
+		text += " (muted)"
+	}
+	return text
+}
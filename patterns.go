@@ -0,0 +1,438 @@
+package main
+
+import (
+	"fmt"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/mail"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// Fields of email which pattern conditions check
+const (
+	patternFieldSubject    = "subject"
+	patternFieldFromEmail  = "from_email"
+	patternFieldFromName   = "from_name"
+	patternFieldFromDomain = "from_domain"
+	patternFieldListID     = "list_id"
+	patternFieldTo         = "to"
+	patternFieldCc         = "cc"
+	patternFieldHeader     = "header"
+	patternFieldBody       = "body"
+)
+
+// maxPatternBodySize is how many bytes of email are fetched for body conditions
+const maxPatternBodySize = 256 << 10
+
+// Match modes of pattern conditions
+const (
+	matchContains = "contains"
+	matchEquals   = "equals"
+	matchRegex    = "regex"
+	matchGlob     = "glob"
+	matchDomain   = "domain"
+)
+
+// Priorities of notification patterns
+const (
+	priorityLow    = "low" //Notified without sound
+	priorityNormal = ""
+	priorityUrgent = "urgent" //Pinned, re-sent until acknowledged and notified even during quiet hours
+)
+
+var priorityNames = map[string]string{priorityLow: "low", priorityNormal: "normal", priorityUrgent: "urgent"}
+
+var patternFieldNames = map[string]string{
+	patternFieldSubject:    "subject",
+	patternFieldFromEmail:  "from email",
+	patternFieldFromName:   "from person name",
+	patternFieldFromDomain: "from domain",
+	patternFieldListID:     "List-Id",
+	patternFieldTo:         "to",
+	patternFieldCc:         "cc",
+	patternFieldHeader:     "header",
+	patternFieldBody:       "body text",
+}
+
+var headerNameRegexp = regexp.MustCompile(`^[!-9;-~]+$`)
+
+// addressFields are fields with email addresses which could be matched by domain
+var addressFields = map[string]bool{
+	patternFieldFromEmail:  true,
+	patternFieldFromDomain: true,
+	patternFieldTo:         true,
+	patternFieldCc:         true,
+}
+
+// matchContext holds email data checked by patterns
+type matchContext struct {
+	envelope *imap.Envelope
+	header   mail.Header
+	body     string
+}
+
+// newMatchContext reads email envelope, header fields and body text fetched for patterns. Literals are consumed.
+func newMatchContext(msg *imap.Message) *matchContext {
+	ctx := &matchContext{envelope: msg.Envelope}
+	for section, literal := range msg.Body {
+		if literal == nil {
+			continue
+		}
+		switch section.Specifier {
+		case imap.HeaderSpecifier:
+			header, err := readMailHeader(literal)
+			if err != nil {
+				log.Printf("Error reading header of email %d. %v", msg.Uid, err)
+				continue
+			}
+			ctx.header = header
+		case imap.EntireSpecifier:
+			// Body is fetched partially, so parsing error at the end of fetched part is expected
+			text := &EmailNotification{}
+			text.ParseBody(literal)
+			ctx.body = text.Preview
+		}
+	}
+	return ctx
+}
+
+// patternsFetchItems returns header fields and body sections needed to check patterns in addition to envelope
+func patternsFetchItems(patterns []*NotifyPatterns) []imap.FetchItem {
+	fields := make([]string, 0)
+	added := make(map[string]bool)
+	needBody := false
+	for _, pattern := range patterns {
+		for _, condition := range pattern.conditions() {
+			if condition.Field == patternFieldBody {
+				needBody = true
+			}
+			name := condition.headerName()
+			if name != "" && !added[strings.ToLower(name)] {
+				added[strings.ToLower(name)] = true
+				fields = append(fields, name)
+			}
+		}
+	}
+	items := make([]imap.FetchItem, 0, 2)
+	if len(fields) > 0 {
+		section := &imap.BodySectionName{
+			BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier, Fields: fields},
+			Peek:         true,
+		}
+		items = append(items, section.FetchItem())
+	}
+	if needBody {
+		section := &imap.BodySectionName{Peek: true, Partial: []int{0, maxPatternBodySize}}
+		items = append(items, section.FetchItem())
+	}
+	return items
+}
+
+// PatternCondition is single check of email field. Email matches pattern if all its conditions match.
+type PatternCondition struct {
+	Field         string
+	Header        string //Header name for header field
+	Mode          string
+	Value         string
+	CaseSensitive bool
+	Negate        bool //Condition matches if email field doesn't match
+	re            *regexp.Regexp
+}
+
+// headerName returns name of email header checked by condition or empty string if condition checks envelope or body
+func (c *PatternCondition) headerName() string {
+	switch c.Field {
+	case patternFieldListID:
+		return "List-Id"
+	case patternFieldHeader:
+		return c.Header
+	}
+	return ""
+}
+
+// Compile validates condition and prepares regular expression for matching
+func (c *PatternCondition) Compile() error {
+	if _, ok := patternFieldNames[c.Field]; !ok {
+		return fmt.Errorf("unknown field %q", c.Field)
+	}
+	if c.Field == patternFieldHeader && !headerNameRegexp.MatchString(c.Header) {
+		return fmt.Errorf("wrong header name %q", c.Header)
+	}
+	switch c.Mode {
+	case matchContains:
+		return nil
+	case matchEquals:
+		if addressFields[c.Field] && c.Field != patternFieldFromDomain && !validEmailAddress(c.Value) {
+			return fmt.Errorf("email address %q is not valid", c.Value)
+		}
+		return nil
+	case matchDomain:
+		if !addressFields[c.Field] {
+			return fmt.Errorf("domain can be matched only in address fields")
+		}
+		if c.Value == "" || strings.ContainsAny(c.Value, "@ *?") {
+			return fmt.Errorf("domain %q is not valid", c.Value)
+		}
+		return nil
+	case matchRegex, matchGlob:
+		re, err := c.compileRegexp()
+		if err != nil {
+			return err
+		}
+		c.re = re
+		return nil
+	}
+	return fmt.Errorf("unknown match mode %q", c.Mode)
+}
+
+func (c *PatternCondition) compileRegexp() (*regexp.Regexp, error) {
+	expr := c.Value
+	if c.Mode == matchGlob {
+		expr = globToRegexp(c.Value)
+	}
+	if !c.CaseSensitive {
+		expr = "(?i)" + expr
+	}
+	return regexp.Compile(expr)
+}
+
+// globToRegexp converts wildcard pattern to regular expression matching whole value.
+// * matches any characters, ? matches one character.
+func globToRegexp(glob string) string {
+	expr := regexp.QuoteMeta(glob)
+	expr = strings.ReplaceAll(expr, `\*`, ".*")
+	expr = strings.ReplaceAll(expr, `\?`, ".")
+	return "^" + expr + "$"
+}
+
+// validEmailAddress checks that address has local part and domain
+func validEmailAddress(address string) bool {
+	i := strings.LastIndex(address, "@")
+	return i > 0 && i < len(address)-1 && !strings.ContainsAny(address, " \t")
+}
+
+// match checks if any of email values of condition field matches condition.
+// Negated condition matches if none of values match.
+func (c *PatternCondition) match(ctx *matchContext) bool {
+	for _, value := range ctx.values(c) {
+		if c.matchValue(value) {
+			return !c.Negate
+		}
+	}
+	return c.Negate
+}
+
+func (c *PatternCondition) matchValue(value string) bool {
+	if c.Mode == matchDomain {
+		domain := strings.ToLower(value[strings.LastIndex(value, "@")+1:])
+		pattern := strings.ToLower(c.Value)
+		return domain == pattern || strings.HasSuffix(domain, "."+pattern)
+	}
+	if c.Mode == matchRegex || c.Mode == matchGlob {
+		re := c.re
+		if re == nil {
+			var err error
+			if re, err = c.compileRegexp(); err != nil {
+				return false
+			}
+		}
+		return re.MatchString(value)
+	}
+	pattern := c.Value
+	if !c.CaseSensitive {
+		value = strings.ToLower(value)
+		pattern = strings.ToLower(pattern)
+	}
+	if c.Mode == matchEquals {
+		return value == pattern
+	}
+	return strings.Contains(value, pattern)
+}
+
+func (c *PatternCondition) String() string {
+	field := patternFieldNames[c.Field]
+	if c.Field == patternFieldHeader {
+		field += " " + c.Header
+	}
+	text := fmt.Sprintf("%s %s %q", field, c.Mode, c.Value)
+	if c.Negate {
+		text = "not " + text
+	}
+	if c.CaseSensitive {
+		text += " (case sensitive)"
+	}
+	return text
+}
+
+// values returns values of email field checked by condition
+func (ctx *matchContext) values(c *PatternCondition) []string {
+	if name := c.headerName(); name != "" {
+		return ctx.header.Values(name)
+	}
+	if c.Field == patternFieldBody {
+		if ctx.body == "" {
+			return nil
+		}
+		return []string{ctx.body}
+	}
+	if ctx.envelope == nil {
+		return nil
+	}
+	values := make([]string, 0, len(ctx.envelope.From))
+	switch c.Field {
+	case patternFieldSubject:
+		values = append(values, ctx.envelope.Subject)
+	case patternFieldFromEmail:
+		for _, addr := range ctx.envelope.From {
+			values = append(values, addressEmail(addr))
+		}
+	case patternFieldFromName:
+		for _, addr := range ctx.envelope.From {
+			values = append(values, addr.PersonalName)
+		}
+	case patternFieldFromDomain:
+		for _, addr := range ctx.envelope.From {
+			email := addressEmail(addr)
+			values = append(values, email[strings.LastIndex(email, "@")+1:])
+		}
+	case patternFieldTo:
+		for _, addr := range ctx.envelope.To {
+			values = append(values, addressEmail(addr))
+		}
+	case patternFieldCc:
+		for _, addr := range ctx.envelope.Cc {
+			values = append(values, addressEmail(addr))
+		}
+	}
+	return values
+}
+
+// addressEmail returns email address as mailbox@host. Some servers return whole address as mailbox name
+// with empty host, such address is returned as is.
+func addressEmail(addr *imap.Address) string {
+	if addr.HostName == "" {
+		return addr.MailboxName
+	}
+	return addr.MailboxName + "@" + addr.HostName
+}
+
+// conditions returns conditions of pattern. Patterns created before conditions were introduced
+// have one of legacy fields set, they are converted to equivalent condition.
+func (p *NotifyPatterns) conditions() []*PatternCondition {
+	if len(p.Conditions) > 0 {
+		return p.Conditions
+	}
+	conditions := make([]*PatternCondition, 0, 1)
+	if p.Subject != "" {
+		conditions = append(conditions, &PatternCondition{Field: patternFieldSubject, Mode: matchContains, Value: p.Subject})
+	}
+	if p.FromEmail != "" {
+		// Legacy patterns were compared with local part of address only
+		condition := &PatternCondition{Field: patternFieldFromEmail, Mode: matchEquals, Value: p.FromEmail}
+		if !strings.Contains(p.FromEmail, "@") {
+			condition.Mode, condition.Value = matchGlob, p.FromEmail+"@*"
+		}
+		conditions = append(conditions, condition)
+	}
+	if p.FromPersonalName != "" {
+		conditions = append(conditions, &PatternCondition{Field: patternFieldFromName, Mode: matchEquals, Value: p.FromPersonalName})
+	}
+	return conditions
+}
+
+// hasAccount checks if pattern is explicitly scoped to account
+func (p *NotifyPatterns) hasAccount(accountID int) bool {
+	for _, id := range p.AccountIDs {
+		if id == accountID {
+			return true
+		}
+	}
+	return false
+}
+
+// appliesTo checks if pattern is applied to emails of account
+func (p *NotifyPatterns) appliesTo(accountID int) bool {
+	return len(p.AccountIDs) == 0 || p.hasAccount(accountID)
+}
+
+func (p *NotifyPatterns) toggleAccount(accountID int) {
+	for i, id := range p.AccountIDs {
+		if id == accountID {
+			p.AccountIDs = append(p.AccountIDs[:i], p.AccountIDs[i+1:]...)
+			return
+		}
+	}
+	p.AccountIDs = append(p.AccountIDs, accountID)
+}
+
+// editCopy returns copy of pattern for editing. Legacy fields are converted to conditions.
+func (p *NotifyPatterns) editCopy() *NotifyPatterns {
+	edited := &NotifyPatterns{
+		ID:          p.ID,
+		Exclude:     p.Exclude,
+		AccountIDs:  append([]int(nil), p.AccountIDs...),
+		Digest:      p.Digest,
+		Priority:    p.Priority,
+		RequiresAck: p.RequiresAck,
+	}
+	for _, condition := range p.conditions() {
+		conditionCopy := *condition
+		edited.Conditions = append(edited.Conditions, &conditionCopy)
+	}
+	return edited
+}
+
+// applyEdit replaces conditions, scope, delivery and priority settings of pattern with edited ones.
+// Other pattern data is kept.
+func (p *NotifyPatterns) applyEdit(edited *NotifyPatterns) {
+	p.Conditions = edited.Conditions
+	p.AccountIDs = edited.AccountIDs
+	p.Digest = edited.Digest
+	p.Priority = edited.Priority
+	p.RequiresAck = edited.RequiresAck
+	p.Subject = ""
+	p.FromEmail = ""
+	p.FromPersonalName = ""
+}
+
+// Compile validates all pattern conditions
+func (p *NotifyPatterns) Compile() error {
+	for _, condition := range p.Conditions {
+		if err := condition.Compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Match checks if email matches all pattern conditions. Pattern without conditions matches nothing.
+func (p *NotifyPatterns) Match(msg *imap.Message) bool {
+	return p.match(newMatchContext(msg))
+}
+
+func (p *NotifyPatterns) match(ctx *matchContext) bool {
+	conditions := p.conditions()
+	if len(conditions) == 0 {
+		return false
+	}
+	for _, condition := range conditions {
+		if !condition.match(ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *NotifyPatterns) String() string {
+	conditions := p.conditions()
+	parts := make([]string, 0, len(conditions))
+	for _, condition := range conditions {
+		parts = append(parts, condition.String())
+	}
+	text := strings.Join(parts, " AND ")
+	if p.Exclude {
+		text = "Mute: " + text
+	}
+	return text
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"strings"
+	"time"
+	_ "time/tzdata" // time zones of quiet hours must be available without system tzdata
+)
+
+const (
+	quietModeDelay  = "delay"  //Notifications are collected and sent as summary when quiet hours end
+	quietModeSilent = "silent" //Notifications are sent without sound
+)
+
+// quietHoursBatch is key of digest batch with notifications delayed by quiet hours
+const quietHoursBatch = "quiet hours"
+
+const quietHoursHelp = "Usage: /quiethours <from>-<to> [time zone] [delay|silent], for example:\n" +
+	"/quiethours 23:00-07:00 Europe/Moscow delay\n" +
+	"delay - notifications are sent as summary when quiet hours end, silent - notifications are sent without sound.\n" +
+	"Patterns marked urgent are always notified with sound.\n" +
+	"/quiethours off - disable quiet hours"
+
+// QuietHours is daily period when user doesn't want to be disturbed by notifications
+type QuietHours struct {
+	Start    string //HH:MM
+	End      string //HH:MM, can be less than Start if period lasts past midnight
+	TimeZone string //IANA time zone name, UTC if empty
+	Mode     string
+}
+
+// ParseQuietHours parses arguments of /quiethours command. Empty text or "off" disables quiet hours and returns nil.
+func ParseQuietHours(text string) (*QuietHours, error) {
+	args := strings.Fields(text)
+	if len(args) == 0 || (len(args) == 1 && strings.ToLower(args[0]) == "off") {
+		return nil, nil
+	}
+	if len(args) > 3 {
+		return nil, fmt.Errorf("wrong number of arguments")
+	}
+	period := strings.Split(args[0], "-")
+	if len(period) != 2 {
+		return nil, fmt.Errorf("wrong period %q, use HH:MM-HH:MM", args[0])
+	}
+	q := &QuietHours{Mode: quietModeDelay}
+	for i, value := range period {
+		t, err := time.Parse("15:04", value)
+		if err != nil {
+			return nil, fmt.Errorf("wrong time %q, use HH:MM", value)
+		}
+		if i == 0 {
+			q.Start = t.Format("15:04")
+		} else {
+			q.End = t.Format("15:04")
+		}
+	}
+	if q.Start == q.End {
+		return nil, fmt.Errorf("start and end of quiet hours are the same")
+	}
+	for _, arg := range args[1:] {
+		switch strings.ToLower(arg) {
+		case quietModeDelay, quietModeSilent:
+			q.Mode = strings.ToLower(arg)
+		default:
+			if _, err := time.LoadLocation(arg); err != nil {
+				return nil, fmt.Errorf("unknown time zone %q", arg)
+			}
+			q.TimeZone = arg
+		}
+	}
+	return q, nil
+}
+
+// spec returns quiet hours in format accepted by ParseQuietHours
+func (q *QuietHours) spec() string {
+	if q == nil {
+		return ""
+	}
+	return strings.Join(strings.Fields(fmt.Sprintf("%s-%s %s %s", q.Start, q.End, q.TimeZone, q.Mode)), " ")
+}
+
+func (q *QuietHours) String() string {
+	if q == nil {
+		return "off"
+	}
+	timeZone := q.TimeZone
+	if timeZone == "" {
+		timeZone = "UTC"
+	}
+	return fmt.Sprintf("%s-%s %s, %s", q.Start, q.End, timeZone, q.Mode)
+}
+
+func (q *QuietHours) location() *time.Location {
+	location, err := time.LoadLocation(q.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// end returns time when quiet hours active at now end. Returns false if quiet hours are not active.
+func (q *QuietHours) end(now time.Time) (time.Time, bool) {
+	if q == nil {
+		return time.Time{}, false
+	}
+	local := now.In(q.location())
+	at := func(value string, day time.Time) time.Time {
+		t, _ := time.Parse("15:04", value)
+		return time.Date(day.Year(), day.Month(), day.Day(), t.Hour(), t.Minute(), 0, 0, day.Location())
+	}
+	start := at(q.Start, local)
+	end := at(q.End, local)
+	if !start.Before(end) {
+		// Period lasts past midnight: it started yesterday if today's end isn't passed yet
+		if local.Before(end) {
+			start = start.AddDate(0, 0, -1)
+		} else {
+			end = end.AddDate(0, 0, 1)
+		}
+	}
+	if local.Before(start) || !local.Before(end) {
+		return time.Time{}, false
+	}
+	return end, true
+}
+
+// quietDelivery returns how notification matched by pattern is delivered at now:
+// whether it is delayed until returned time or sent silently. Notifications which require acknowledgement
+// are never delayed, so reminders are tracked from the start.
+func (u *StoredUser) quietDelivery(pattern *NotifyPatterns, now time.Time) (time.Time, bool, bool) {
+	end, active := u.QuietHours.end(now)
+	if !active || (pattern != nil && pattern.Priority == priorityUrgent) {
+		return time.Time{}, false, false
+	}
+	if u.QuietHours.Mode == quietModeSilent || (pattern != nil && pattern.RequiresAck) {
+		return time.Time{}, false, true
+	}
+	return end, true, false
+}
+
+// QuietHoursHandler shows or changes user's quiet hours
+func (h *UserDialogHandler) QuietHoursHandler(msg string, user *StoredUser) (*tgbotapi.MessageConfig, error) {
+	args := strings.TrimSpace(strings.TrimPrefix(msg, "/quiethours"))
+	rMsgText := ""
+	if args == "" {
+		rMsgText = "Quiet hours: " + user.QuietHours.String() + "\n\n" + quietHoursHelp
+	} else if quietHours, err := ParseQuietHours(args); err != nil {
+		rMsgText = "Wrong quiet hours: " + err.Error() + "\n\n" + quietHoursHelp
+	} else {
+		user.QuietHours = quietHours
+		user.Save()
+		rMsgText = "Quiet hours: " + quietHours.String()
+	}
+	rMsg := tgbotapi.NewMessage(user.ChatID, rMsgText)
+	return &rMsg, nil
+}
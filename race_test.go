@@ -0,0 +1,6 @@
+//go:build race
+
+package main
+
+// raceEnabled is true when tests are run with race detector
+const raceEnabled = true
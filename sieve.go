@@ -0,0 +1,554 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Sieve scripts (RFC 5228) are converted to notification patterns. Supported subset:
+// if/elsif/else, allof, anyof, not, header and address tests with :is, :contains, :matches and :regex
+// match types, :all and :domain address parts and :comparator. Branches with discard or reject actions
+// become mute rules, other branches become notification patterns.
+
+const (
+	sieveIdent = iota
+	sieveTag
+	sieveString
+	sieveNumber
+	sievePunct
+)
+
+// sieveClauseLimit limits number of patterns created from one branch of script
+const sieveClauseLimit = 32
+
+type sieveToken struct {
+	kind int
+	text string
+	line int
+}
+
+// sieveArg is tag, string or string list argument of command or test
+type sieveArg struct {
+	tag     string
+	strings []string
+}
+
+// sieveNode is command or test with arguments, nested tests and block of commands
+type sieveNode struct {
+	name  string
+	line  int
+	args  []sieveArg
+	tests []*sieveNode
+	block []*sieveNode
+}
+
+func tokenizeSieve(script string) ([]sieveToken, error) {
+	tokens := make([]sieveToken, 0)
+	line := 1
+	isIdentChar := func(ch byte) bool {
+		return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')
+	}
+	for i := 0; i < len(script); {
+		ch := script[i]
+		switch {
+		case ch == '\n':
+			line += 1
+			i += 1
+		case ch == ' ' || ch == '\t' || ch == '\r':
+			i += 1
+		case ch == '#':
+			for i < len(script) && script[i] != '\n' {
+				i += 1
+			}
+		case strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unclosed comment", line)
+			}
+			line += strings.Count(script[i:i+2+end], "\n")
+			i += end + 4
+		case ch == '"':
+			var b strings.Builder
+			start := line
+			j := i + 1
+			for ; j < len(script) && script[j] != '"'; j++ {
+				if script[j] == '\\' && j+1 < len(script) {
+					j += 1
+				}
+				if script[j] == '\n' {
+					line += 1
+				}
+				b.WriteByte(script[j])
+			}
+			if j >= len(script) {
+				return nil, fmt.Errorf("line %d: unclosed string", start)
+			}
+			tokens = append(tokens, sieveToken{kind: sieveString, text: b.String(), line: start})
+			i = j + 1
+		case ch == ':':
+			j := i + 1
+			for j < len(script) && isIdentChar(script[j]) {
+				j += 1
+			}
+			tokens = append(tokens, sieveToken{kind: sieveTag, text: strings.ToLower(script[i:j]), line: line})
+			i = j
+		case ch >= '0' && ch <= '9':
+			j := i
+			for j < len(script) && script[j] >= '0' && script[j] <= '9' {
+				j += 1
+			}
+			if j < len(script) && strings.ContainsRune("KkMmGg", rune(script[j])) {
+				j += 1
+			}
+			tokens = append(tokens, sieveToken{kind: sieveNumber, text: script[i:j], line: line})
+			i = j
+		case isIdentChar(ch):
+			j := i
+			for j < len(script) && isIdentChar(script[j]) {
+				j += 1
+			}
+			ident := strings.ToLower(script[i:j])
+			if ident == "text" && j < len(script) && script[j] == ':' {
+				return nil, fmt.Errorf("line %d: multi-line strings are not supported", line)
+			}
+			tokens = append(tokens, sieveToken{kind: sieveIdent, text: ident, line: line})
+			i = j
+		case strings.IndexByte("[](),{};", ch) >= 0:
+			tokens = append(tokens, sieveToken{kind: sievePunct, text: string(ch), line: line})
+			i += 1
+		default:
+			return nil, fmt.Errorf("line %d: unexpected character %q", line, ch)
+		}
+	}
+	return tokens, nil
+}
+
+type sieveParser struct {
+	tokens []sieveToken
+	pos    int
+}
+
+func (p *sieveParser) peek() *sieveToken {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+func (p *sieveParser) isPunct(text string) bool {
+	t := p.peek()
+	return t != nil && t.kind == sievePunct && t.text == text
+}
+
+func (p *sieveParser) lastLine() int {
+	if len(p.tokens) == 0 {
+		return 1
+	}
+	return p.tokens[len(p.tokens)-1].line
+}
+
+func (p *sieveParser) expectPunct(text string) error {
+	t := p.peek()
+	if t == nil {
+		return fmt.Errorf("line %d: expected %q at end of script", p.lastLine(), text)
+	}
+	if t.kind != sievePunct || t.text != text {
+		return fmt.Errorf("line %d: expected %q, found %q", t.line, text, t.text)
+	}
+	p.pos += 1
+	return nil
+}
+
+func (p *sieveParser) parseCommands(inBlock bool) ([]*sieveNode, error) {
+	commands := make([]*sieveNode, 0)
+	for {
+		t := p.peek()
+		if t == nil {
+			if inBlock {
+				return nil, fmt.Errorf("line %d: missing \"}\"", p.lastLine())
+			}
+			return commands, nil
+		}
+		if t.kind == sievePunct && t.text == "}" {
+			if !inBlock {
+				return nil, fmt.Errorf("line %d: unexpected \"}\"", t.line)
+			}
+			return commands, nil
+		}
+		command, err := p.parseNode()
+		if err != nil {
+			return nil, err
+		}
+		if p.isPunct("{") {
+			p.pos += 1
+			if command.block, err = p.parseCommands(true); err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct("}"); err != nil {
+				return nil, err
+			}
+		} else if command.name == "if" || command.name == "elsif" || command.name == "else" {
+			return nil, fmt.Errorf("line %d: %s requires block", command.line, command.name)
+		} else if err := p.expectPunct(";"); err != nil {
+			return nil, err
+		}
+		commands = append(commands, command)
+	}
+}
+
+// parseNode parses identifier with arguments and nested tests
+func (p *sieveParser) parseNode() (*sieveNode, error) {
+	t := p.peek()
+	if t == nil {
+		return nil, fmt.Errorf("line %d: unexpected end of script", p.lastLine())
+	}
+	if t.kind != sieveIdent {
+		return nil, fmt.Errorf("line %d: expected command or test, found %q", t.line, t.text)
+	}
+	p.pos += 1
+	node := &sieveNode{name: t.text, line: t.line}
+	for {
+		t := p.peek()
+		if t == nil {
+			return node, nil
+		}
+		switch {
+		case t.kind == sieveTag:
+			node.args = append(node.args, sieveArg{tag: t.text})
+			p.pos += 1
+		case t.kind == sieveString:
+			node.args = append(node.args, sieveArg{strings: []string{t.text}})
+			p.pos += 1
+		case t.kind == sieveNumber:
+			node.args = append(node.args, sieveArg{strings: []string{t.text}})
+			p.pos += 1
+		case t.kind == sievePunct && t.text == "[":
+			p.pos += 1
+			list := make([]string, 0)
+			for {
+				t := p.peek()
+				if t == nil || t.kind != sieveString {
+					return nil, fmt.Errorf("line %d: expected string in list", node.line)
+				}
+				list = append(list, t.text)
+				p.pos += 1
+				if p.isPunct("]") {
+					p.pos += 1
+					break
+				}
+				if err := p.expectPunct(","); err != nil {
+					return nil, err
+				}
+			}
+			node.args = append(node.args, sieveArg{strings: list})
+		case t.kind == sievePunct && t.text == "(":
+			p.pos += 1
+			for {
+				test, err := p.parseNode()
+				if err != nil {
+					return nil, err
+				}
+				node.tests = append(node.tests, test)
+				if p.isPunct(")") {
+					p.pos += 1
+					return node, nil
+				}
+				if err := p.expectPunct(","); err != nil {
+					return nil, err
+				}
+			}
+		case t.kind == sieveIdent:
+			test, err := p.parseNode()
+			if err != nil {
+				return nil, err
+			}
+			node.tests = append(node.tests, test)
+			return node, nil
+		default:
+			return node, nil
+		}
+	}
+}
+
+// parseSieve parses Sieve script to list of commands
+func parseSieve(script string) ([]*sieveNode, error) {
+	tokens, err := tokenizeSieve(script)
+	if err != nil {
+		return nil, err
+	}
+	parser := &sieveParser{tokens: tokens}
+	return parser.parseCommands(false)
+}
+
+// ConvertSieve converts rules of Sieve script to notification patterns.
+// Returns patterns and descriptions of constructs which were not converted.
+func ConvertSieve(script string) ([]*NotifyPatterns, []string, error) {
+	commands, err := parseSieve(script)
+	if err != nil {
+		return nil, nil, err
+	}
+	patterns := make([]*NotifyPatterns, 0)
+	unsupported := make([]string, 0)
+	var previous []*sieveNode
+	for _, command := range commands {
+		var test *sieveNode
+		switch command.name {
+		case "require":
+			continue
+		case "if":
+			previous = nil
+			fallthrough
+		case "elsif":
+			if command.name == "elsif" && previous == nil {
+				unsupported = append(unsupported, fmt.Sprintf("line %d: elsif without if", command.line))
+				continue
+			}
+			if len(command.tests) != 1 {
+				unsupported = append(unsupported, fmt.Sprintf("line %d: %s without test", command.line, command.name))
+				continue
+			}
+			// Branch is taken only if tests of previous branches failed
+			test = &sieveNode{name: "allof", line: command.line, tests: []*sieveNode{command.tests[0]}}
+			for _, prevTest := range previous {
+				test.tests = append(test.tests, &sieveNode{name: "not", line: prevTest.line, tests: []*sieveNode{prevTest}})
+			}
+			previous = append(previous, command.tests[0])
+		case "else":
+			if previous == nil {
+				unsupported = append(unsupported, fmt.Sprintf("line %d: else without if", command.line))
+				continue
+			}
+			test = &sieveNode{name: "allof", line: command.line}
+			for _, prevTest := range previous {
+				test.tests = append(test.tests, &sieveNode{name: "not", line: prevTest.line, tests: []*sieveNode{prevTest}})
+			}
+			previous = nil
+		default:
+			previous = nil
+			if command.name != "keep" && command.name != "stop" {
+				unsupported = append(unsupported, fmt.Sprintf("line %d: %s outside of if", command.line, command.name))
+			}
+			continue
+		}
+
+		mute := false
+		for _, action := range command.block {
+			switch action.name {
+			case "discard", "reject", "ereject":
+				mute = true
+			case "if", "elsif", "else":
+				unsupported = append(unsupported, fmt.Sprintf("line %d: nested %s is ignored", action.line, action.name))
+			}
+		}
+		clauses, err := convertSieveTest(test, false)
+		if err != nil {
+			unsupported = append(unsupported, err.Error())
+			continue
+		}
+		for _, conditions := range clauses {
+			if len(conditions) == 0 {
+				unsupported = append(unsupported, fmt.Sprintf("line %d: rule without conditions", command.line))
+				continue
+			}
+			patterns = append(patterns, &NotifyPatterns{Exclude: mute, Conditions: conditions})
+		}
+	}
+	return patterns, unsupported, nil
+}
+
+// convertSieveTest converts test to disjunction of condition lists: email matches test if it matches
+// all conditions of any list
+func convertSieveTest(test *sieveNode, negate bool) ([][]*PatternCondition, error) {
+	switch test.name {
+	case "not":
+		if len(test.tests) != 1 {
+			return nil, fmt.Errorf("line %d: not requires one test", test.line)
+		}
+		return convertSieveTest(test.tests[0], !negate)
+	case "allof", "anyof":
+		// not allof(a, b) is anyof(not a, not b) and vice versa
+		conjunction := (test.name == "allof") != negate
+		var result [][]*PatternCondition
+		if conjunction {
+			result = [][]*PatternCondition{{}}
+		}
+		for _, child := range test.tests {
+			clauses, err := convertSieveTest(child, negate)
+			if err != nil {
+				return nil, err
+			}
+			if conjunction {
+				result = combineSieveClauses(result, clauses)
+			} else {
+				result = append(result, clauses...)
+			}
+			if len(result) > sieveClauseLimit {
+				return nil, fmt.Errorf("line %d: rule is too complex", test.line)
+			}
+		}
+		return result, nil
+	case "header", "address":
+		conditions, err := convertSieveMatch(test)
+		if err != nil {
+			return nil, err
+		}
+		if negate {
+			// not (a or b) is (not a) and (not b)
+			for _, condition := range conditions {
+				condition.Negate = true
+			}
+			return [][]*PatternCondition{conditions}, nil
+		}
+		result := make([][]*PatternCondition, 0, len(conditions))
+		for _, condition := range conditions {
+			result = append(result, []*PatternCondition{condition})
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("line %d: test %s is not supported", test.line, test.name)
+}
+
+// combineSieveClauses returns conjunction of two disjunctions
+func combineSieveClauses(left [][]*PatternCondition, right [][]*PatternCondition) [][]*PatternCondition {
+	result := make([][]*PatternCondition, 0, len(left)*len(right))
+	for _, l := range left {
+		for _, r := range right {
+			clause := make([]*PatternCondition, 0, len(l)+len(r))
+			for _, condition := range append(append([]*PatternCondition(nil), l...), r...) {
+				conditionCopy := *condition
+				clause = append(clause, &conditionCopy)
+			}
+			result = append(result, clause)
+		}
+	}
+	return result
+}
+
+// convertSieveMatch converts header or address test to conditions, email matches test if it matches any condition
+func convertSieveMatch(test *sieveNode) ([]*PatternCondition, error) {
+	mode := matchEquals
+	addressPart := ":all"
+	caseSensitive := false
+	if len(test.tests) > 0 {
+		return nil, fmt.Errorf("line %d: unexpected test after %s", test.line, test.name)
+	}
+	positional := make([][]string, 0, 2)
+	for i := 0; i < len(test.args); i++ {
+		arg := test.args[i]
+		switch arg.tag {
+		case "":
+			positional = append(positional, arg.strings)
+		case ":is":
+			mode = matchEquals
+		case ":contains":
+			mode = matchContains
+		case ":matches":
+			mode = matchGlob
+		case ":regex":
+			mode = matchRegex
+		case ":all", ":domain":
+			if test.name != "address" {
+				return nil, fmt.Errorf("line %d: %s is supported only in address test", test.line, arg.tag)
+			}
+			addressPart = arg.tag
+		case ":comparator":
+			if i+1 >= len(test.args) || len(test.args[i+1].strings) != 1 {
+				return nil, fmt.Errorf("line %d: comparator name is missing", test.line)
+			}
+			i += 1
+			switch test.args[i].strings[0] {
+			case "i;octet":
+				caseSensitive = true
+			case "i;ascii-casemap":
+				caseSensitive = false
+			default:
+				return nil, fmt.Errorf("line %d: comparator %s is not supported", test.line, test.args[i].strings[0])
+			}
+		default:
+			return nil, fmt.Errorf("line %d: %s %s is not supported", test.line, test.name, arg.tag)
+		}
+	}
+	if len(positional) != 2 {
+		return nil, fmt.Errorf("line %d: %s requires header names and keys", test.line, test.name)
+	}
+
+	conditions := make([]*PatternCondition, 0, len(positional[0])*len(positional[1]))
+	for _, header := range positional[0] {
+		for _, key := range positional[1] {
+			condition := &PatternCondition{Mode: mode, Value: key, CaseSensitive: caseSensitive}
+			if test.name == "header" {
+				switch strings.ToLower(header) {
+				case "subject":
+					condition.Field = patternFieldSubject
+				case "list-id":
+					condition.Field = patternFieldListID
+				default:
+					condition.Field = patternFieldHeader
+					condition.Header = header
+				}
+			} else if err := setSieveAddressField(condition, strings.ToLower(header), addressPart); err != nil {
+				return nil, fmt.Errorf("line %d: %v", test.line, err)
+			}
+			if err := condition.Compile(); err != nil {
+				return nil, fmt.Errorf("line %d: %v", test.line, err)
+			}
+			conditions = append(conditions, condition)
+		}
+	}
+	return conditions, nil
+}
+
+// setSieveAddressField sets field of condition for address test. Domain of recipients is matched with wildcard
+// because only sender domain is separate field.
+func setSieveAddressField(condition *PatternCondition, header string, addressPart string) error {
+	fields := map[string]string{"from": patternFieldFromEmail, "to": patternFieldTo, "cc": patternFieldCc}
+	field, ok := fields[header]
+	if !ok {
+		return fmt.Errorf("address test for %s header is not supported", header)
+	}
+	condition.Field = field
+	if addressPart == ":all" {
+		return nil
+	}
+	if field == patternFieldFromEmail {
+		condition.Field = patternFieldFromDomain
+		return nil
+	}
+	switch condition.Mode {
+	case matchEquals, matchGlob:
+		condition.Value = "*@" + condition.Value
+	case matchContains:
+		condition.Value = "*@*" + condition.Value + "*"
+	default:
+		return fmt.Errorf("%s domain can't be matched with %s", header, condition.Mode)
+	}
+	condition.Mode = matchGlob
+	return nil
+}
+
+// sieveImport builds import which adds patterns converted from Sieve script to user's patterns
+func sieveImport(script string, user *StoredUser) (*userImport, []string, error) {
+	patterns, unsupported, err := ConvertSieve(script)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(patterns) == 0 {
+		return nil, unsupported, fmt.Errorf("no rules could be converted to patterns")
+	}
+	imp := &userImport{patterns: append([]*NotifyPatterns(nil), user.Patterns...), quietHours: user.QuietHours}
+	ids := make(map[int]bool, len(user.Patterns))
+	for _, uPattern := range user.Patterns {
+		ids[uPattern.ID] = true
+	}
+	newID := int(time.Now().Unix())
+	for _, pattern := range patterns {
+		for ids[newID] {
+			newID += 1
+		}
+		pattern.ID = newID
+		ids[newID] = true
+		imp.patterns = append(imp.patterns, pattern)
+	}
+	return imp, unsupported, nil
+}
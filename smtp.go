@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/mail"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"io"
+	"log"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	smtpSecurityTLS      = "tls"
+	smtpSecurityStartTLS = "starttls"
+	smtpTimeout          = 30 * time.Second
+	// sentNotificationsLimit is how many last notifications per user could be replied
+	sentNotificationsLimit = 1000
+)
+
+var referencesSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier, Fields: []string{"References"}},
+	Peek:         true,
+}
+
+// sentNotifications remembers which email every notification message is about, so user can reply to it
+type sentNotifications struct {
+	mu    sync.Mutex
+	refs  map[int]EmailRef
+	order []int
+}
+
+func (s *sentNotifications) add(messageID int, ref EmailRef) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs == nil {
+		s.refs = make(map[int]EmailRef)
+	}
+	s.refs[messageID] = ref
+	s.order = append(s.order, messageID)
+	if len(s.order) > sentNotificationsLimit {
+		delete(s.refs, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+func (s *sentNotifications) get(messageID int) (EmailRef, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ref, ok := s.refs[messageID]
+	return ref, ok
+}
+
+// ReplyToEmailHandler sends text of user's Telegram reply as reply to email from notification
+func (h *UserDialogHandler) ReplyToEmailHandler(text string, ref EmailRef, user *StoredUser) (*tgbotapi.MessageConfig, error) {
+	var boxHandler *EmailBoxHandler
+	for _, bHandler := range user.emailBoxHandlers {
+		if bHandler.eAccount.id == ref.AccountID {
+			boxHandler = bHandler
+			break
+		}
+	}
+	rMsgText := ""
+	switch {
+	case boxHandler == nil:
+		rMsgText = "Account of this email was removed"
+	case boxHandler.eAccount.smtpHost == "":
+		rMsgText = fmt.Sprintf("SMTP is not configured for %s. Use /changeaccount to set SMTP settings", boxHandler.eAccount.login)
+	case strings.TrimSpace(text) == "":
+		rMsgText = "Only text replies are supported"
+	default:
+		// Reply is sent in background, it connects to IMAP and SMTP servers
+		rMsg := tgbotapi.NewMessage(user.ChatID, "")
+		rMsg.ReplyToMessageID = user.LastMessageId
+		go func() {
+			recipients, err := boxHandler.ReplyToEmail(ref, text)
+			if err != nil {
+				log.Printf("Error sending reply from %s. %v", boxHandler.eAccount.login, err)
+				rMsg.Text = "Error sending reply: " + err.Error()
+			} else {
+				rMsg.Text = "Reply sent to " + strings.Join(recipients, ", ")
+			}
+			if _, err := boxHandler.messenger.Send(rMsg); err != nil {
+				log.Println("Error sending message to user. ", err)
+			}
+		}()
+		return nil, nil
+	}
+	rMsg := tgbotapi.NewMessage(user.ChatID, rMsgText)
+	rMsg.ReplyToMessageID = user.LastMessageId
+	return &rMsg, nil
+}
+
+// ReplyToEmail fetches original email, sends reply through account's SMTP server and marks original as answered.
+// Returns reply recipients.
+func (handler *EmailBoxHandler) ReplyToEmail(ref EmailRef, text string) ([]string, error) {
+	src, err := handler.Dial()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Logout()
+
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, referencesSection.FetchItem()}
+	messages, err := src.Fetch(ref.Folder, []uint32{ref.UID}, items)
+	if err != nil {
+		return nil, err
+	}
+	var original *imap.Message
+	for _, msg := range messages {
+		if msg.Uid == ref.UID {
+			original = msg
+		}
+	}
+	if original == nil || original.Envelope == nil {
+		return nil, fmt.Errorf("email not found, it could be moved or deleted")
+	}
+	var references []string
+	if headerReader := original.GetBody(referencesSection); headerReader != nil {
+		header, err := readMailHeader(headerReader)
+		if err == nil {
+			references, _ = header.MsgIDList("References")
+		}
+	}
+
+	from := &mail.Address{Address: handler.eAccount.login}
+	reply, recipients, err := composeReply(from, original.Envelope, references, text)
+	if err != nil {
+		return nil, err
+	}
+	if err := handler.sendMail(recipients, reply); err != nil {
+		return nil, err
+	}
+	if err := src.AddFlags(ref.Folder, []uint32{ref.UID}, imap.AnsweredFlag); err != nil {
+		log.Printf("Error marking email %d in %s as answered. %v", ref.UID, ref.Folder, err)
+	}
+	return recipients, nil
+}
+
+// composeReply builds reply message threaded to original email with In-Reply-To and References headers
+func composeReply(from *mail.Address, original *imap.Envelope, references []string, text string) ([]byte, []string, error) {
+	replyTo := original.ReplyTo
+	if len(replyTo) == 0 {
+		replyTo = original.From
+	}
+	to := make([]*mail.Address, 0, len(replyTo))
+	recipients := make([]string, 0, len(replyTo))
+	for _, addr := range replyTo {
+		email := addr.Address()
+		if addr.MailboxName == "" || addr.HostName == "" {
+			continue
+		}
+		to = append(to, &mail.Address{Name: addr.PersonalName, Address: email})
+		recipients = append(recipients, email)
+	}
+	if len(recipients) == 0 {
+		return nil, nil, fmt.Errorf("original email has no sender address")
+	}
+
+	subject := original.Subject
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+
+	var h mail.Header
+	h.SetDate(time.Now())
+	h.SetAddressList("From", []*mail.Address{from})
+	h.SetAddressList("To", to)
+	h.SetSubject(subject)
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	if err := h.GenerateMessageID(); err != nil {
+		return nil, nil, err
+	}
+	if originalID := strings.Trim(original.MessageId, "<> "); originalID != "" {
+		h.SetMsgIDList("In-Reply-To", []string{originalID})
+		h.SetMsgIDList("References", append(references, originalID))
+	}
+
+	var buf bytes.Buffer
+	w, err := mail.CreateSingleInlineWriter(&buf, h)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := w.Write([]byte(strings.ReplaceAll(text, "\n", "\r\n"))); err != nil {
+		return nil, nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), recipients, nil
+}
+
+func readMailHeader(r io.Reader) (mail.Header, error) {
+	mr, err := mail.CreateReader(r)
+	if err != nil {
+		return mail.Header{}, err
+	}
+	return mr.Header, nil
+}
+
+// sendMail sends message through account's SMTP server. IMAP credentials are used if SMTP login is not set.
+func (handler *EmailBoxHandler) sendMail(recipients []string, message []byte) error {
+	account := handler.eAccount
+	host, _, err := net.SplitHostPort(account.smtpHost)
+	if err != nil {
+		return err
+	}
+	login, sealedPassword := account.login, account.password
+	if account.smtpLogin != "" {
+		login, sealedPassword = account.smtpLogin, account.smtpPassword
+	}
+	password, err := credentials.Open(sealedPassword)
+	if err != nil {
+		return err
+	}
+
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	tlsConfig := &tls.Config{ServerName: host}
+	var conn net.Conn
+	if account.smtpSecurity == smtpSecurityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", account.smtpHost, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", account.smtpHost)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(2 * smtpTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if account.smtpSecurity == smtpSecurityStartTLS {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if err := c.Auth(smtp.PlainAuth("", login, password, host)); err != nil {
+		return err
+	}
+	if err := c.Mail(account.login); err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		if err := c.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// SMTPHostEntered saves SMTP host of selected account and asks for connection security
+func (h *UserDialogHandler) SMTPHostEntered(msg string, user *StoredUser) (*tgbotapi.MessageConfig, error) {
+	host, portStr, err := net.SplitHostPort(strings.TrimSpace(msg))
+	port, portErr := strconv.Atoi(portStr)
+	if err != nil || portErr != nil || host == "" || port <= 0 || port > 65535 {
+		rMsg := tgbotapi.NewMessage(user.ChatID, "Wrong format for SMTP host. Please enter host in format: <host>:<port>")
+		return &rMsg, nil
+	}
+	h.newEmailAccount.smtpHost = net.JoinHostPort(host, portStr)
+	h.lastSubCommand = ""
+	user.Save()
+	rMsg := tgbotapi.NewMessage(user.ChatID, "Choose connection security for "+h.newEmailAccount.smtpHost)
+	rMsg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("TLS (usually port 465)", "smtps_"+smtpSecurityTLS),
+			tgbotapi.NewInlineKeyboardButtonData("STARTTLS (usually port 587)", "smtps_"+smtpSecurityStartTLS),
+		),
+	)
+	return &rMsg, nil
+}
+
+// smtpCredentialsKeyboard asks whether SMTP server uses same credentials as IMAP
+func smtpCredentialsKeyboard() tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Same as IMAP", "smtpcred_same"),
+			tgbotapi.NewInlineKeyboardButtonData("Other login and password", "smtpcred_other"),
+		),
+	)
+}
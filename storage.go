@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Storage keeps bot users with their email accounts and notify patterns between bot restarts
+type Storage interface {
+	LoadUsers() ([]*StoredUser, error)
+	SaveUser(user *StoredUser) error
+	SaveUsers(users []*StoredUser) error
+	Close() error
+}
+
+var usersBucket = []byte("users")
+
+// storedUserRecord is serialized form of StoredUser
+type storedUserRecord struct {
+	ID         int
+	Login      string
+	ChatID     int64
+	Accounts   []*storedAccountRecord
+	Patterns   []*NotifyPatterns
+	Digests    []*DigestBatch
+	Acks       []*PendingAck
+	QuietHours *QuietHours
+}
+
+// storedAccountRecord is serialized form of StoredEmailAccount
+type storedAccountRecord struct {
+	ID           int
+	IMAPHost     string
+	Login        string
+	Password     string
+	UpdateT      int
+	IsActive     bool
+	PushMode     bool
+	Digest       *DigestSchedule
+	Folders      []string
+	Cursors      map[string]MailboxCursor
+	SMTPHost     string
+	SMTPSecurity string
+	SMTPLogin    string
+	SMTPPassword string
+}
+
+func newUserRecord(user *StoredUser) *storedUserRecord {
+	record := &storedUserRecord{
+		ID:         user.ID,
+		Login:      user.Login,
+		ChatID:     user.ChatID,
+		Accounts:   make([]*storedAccountRecord, 0, len(user.emailBoxHandlers)),
+		Patterns:   user.Patterns,
+		Digests:    user.digests.snapshot(),
+		Acks:       user.acks.snapshot(),
+		QuietHours: user.QuietHours,
+	}
+	for _, boxHandler := range user.emailBoxHandlers {
+		account := boxHandler.eAccount
+		record.Accounts = append(record.Accounts, &storedAccountRecord{
+			ID:           account.id,
+			IMAPHost:     account.imapHost,
+			Login:        account.login,
+			Password:     account.password,
+			UpdateT:      account.updateT,
+			IsActive:     account.isActive,
+			PushMode:     account.pushMode,
+			Digest:       account.digest,
+			Folders:      account.monitoredFolders(),
+			Cursors:      account.folderCursors(),
+			SMTPHost:     account.smtpHost,
+			SMTPSecurity: account.smtpSecurity,
+			SMTPLogin:    account.smtpLogin,
+			SMTPPassword: account.smtpPassword,
+		})
+	}
+	return record
+}
+
+// toUser restores StoredUser with email box handlers for all stored accounts. Handlers are not started.
+func (r *storedUserRecord) toUser(storage Storage) *StoredUser {
+	user := &StoredUser{
+		ID:               r.ID,
+		Login:            r.Login,
+		ChatID:           r.ChatID,
+		SearchPatterns:   make([]string, 0),
+		dialogHandler:    &UserDialogHandler{},
+		emailBoxHandlers: make([]*EmailBoxHandler, 0, len(r.Accounts)),
+		Patterns:         r.Patterns,
+		QuietHours:       r.QuietHours,
+		storage:          storage,
+	}
+	user.digests.restore(r.Digests)
+	user.acks.restore(r.Acks)
+	if user.Patterns == nil {
+		user.Patterns = make([]*NotifyPatterns, 0)
+	}
+	for _, pattern := range user.Patterns {
+		if err := pattern.Compile(); err != nil {
+			log.Printf("Error in pattern %d of user %d. %v", pattern.ID, user.ID, err)
+		}
+	}
+	for _, accRecord := range r.Accounts {
+		account := &StoredEmailAccount{
+			id:           accRecord.ID,
+			imapHost:     accRecord.IMAPHost,
+			login:        accRecord.Login,
+			password:     accRecord.Password,
+			updateT:      accRecord.UpdateT,
+			isActive:     accRecord.IsActive,
+			pushMode:     accRecord.PushMode,
+			digest:       accRecord.Digest,
+			folders:      accRecord.Folders,
+			cursors:      accRecord.Cursors,
+			smtpHost:     accRecord.SMTPHost,
+			smtpSecurity: accRecord.SMTPSecurity,
+			smtpLogin:    accRecord.SMTPLogin,
+			smtpPassword: accRecord.SMTPPassword,
+		}
+		user.emailBoxHandlers = append(user.emailBoxHandlers, NewEmailBoxHandler(account, user))
+	}
+	return user
+}
+
+// BoltStorage is Storage implementation on top of embedded BoltDB file
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening database %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(usersBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating users bucket: %v", err)
+	}
+	return &BoltStorage{db: db}, nil
+}
+
+func (s *BoltStorage) LoadUsers() ([]*StoredUser, error) {
+	users := make([]*StoredUser, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(k, v []byte) error {
+			record := &storedUserRecord{}
+			if err := json.Unmarshal(v, record); err != nil {
+				return fmt.Errorf("error decoding user %s: %v", k, err)
+			}
+			users = append(users, record.toUser(s))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *BoltStorage) SaveUser(user *StoredUser) error {
+	return s.SaveUsers([]*StoredUser{user})
+}
+
+// SaveUsers writes all users in single transaction
+func (s *BoltStorage) SaveUsers(users []*StoredUser) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		for _, user := range users {
+			data, err := json.Marshal(newUserRecord(user))
+			if err != nil {
+				return fmt.Errorf("error encoding user %d: %v", user.ID, err)
+			}
+			if err := bucket.Put([]byte(strconv.Itoa(user.ID)), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorage) Close() error {
+	return s.db.Close()
+}
+
+// Save writes user with all accounts and patterns to storage if storage is configured.
+// Caller holds user's lock, update loop holds it while handling user's dialogs.
+func (u *StoredUser) Save() {
+	if u.storage == nil {
+		return
+	}
+	if err := u.storage.SaveUser(u); err != nil {
+		log.Println("Error saving user", u.ID, err)
+	}
+}
+
+// saveFromWorker saves user from fetching worker, so user isn't serialized while dialog changes it
+func (u *StoredUser) saveFromWorker() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.Save()
+}
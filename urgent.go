@@ -0,0 +1,252 @@
+package main
+
+import (
+	"flag"
+	"github.com/emersion/go-imap"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"log"
+	"sync"
+	"time"
+)
+
+var UrgentResendT = flag.Int("urgentresend", 10, "Minutes after which unacknowledged urgent notification is sent again")
+var AckReminderT = flag.Int("ackreminder", 5, "Minutes before first reminder about email which requires acknowledgement")
+
+// urgentResendLimit is how many times urgent notification is re-sent if user doesn't acknowledge it
+const urgentResendLimit = 3
+
+// ackReminderMaxT limits interval between reminders, which is doubled after every reminder
+const ackReminderMaxT = 2 * time.Hour
+
+// PendingAck is urgent notification waiting for user's acknowledgement
+type PendingAck struct {
+	Notification *EmailNotification
+	MessageID    int //Last sent message, it is unpinned when notification is acknowledged
+	Sent         int
+	Next         time.Time
+}
+
+// ackQueue keeps user's unacknowledged notifications, shared between fetching workers and reminders sender
+type ackQueue struct {
+	mu      sync.Mutex
+	pending map[EmailRef]*PendingAck
+}
+
+// reminderInterval returns time until next reminder about notification which was sent given times.
+// Urgent notifications are re-sent at fixed interval, reminders for emails which require acknowledgement escalate.
+func reminderInterval(notification *EmailNotification, sent int) time.Duration {
+	if !notification.RequiresAck {
+		return time.Duration(*UrgentResendT) * time.Minute
+	}
+	interval := time.Duration(*AckReminderT) * time.Minute
+	for i := 1; i < sent && interval < ackReminderMaxT; i++ {
+		interval *= 2
+	}
+	if interval > ackReminderMaxT {
+		interval = ackReminderMaxT
+	}
+	return interval
+}
+
+// track registers sent notification which waits for acknowledgement. Notification sent again updates existing record.
+func (q *ackQueue) track(notification *EmailNotification, messageID int, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending == nil {
+		q.pending = make(map[EmailRef]*PendingAck)
+	}
+	ref := notification.ref()
+	ack, ok := q.pending[ref]
+	if !ok {
+		ack = &PendingAck{Notification: notification}
+		q.pending[ref] = ack
+	}
+	ack.sent(messageID, now)
+}
+
+// update registers re-sent notification. Returns false if notification was acknowledged, it isn't tracked again then.
+func (q *ackQueue) update(notification *EmailNotification, messageID int, now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ack, ok := q.pending[notification.ref()]
+	if !ok {
+		return false
+	}
+	ack.sent(messageID, now)
+	return true
+}
+
+func (ack *PendingAck) sent(messageID int, now time.Time) {
+	ack.MessageID = messageID
+	ack.Sent += 1
+	ack.Next = now.Add(reminderInterval(ack.Notification, ack.Sent))
+}
+
+// postpone counts failed re-send as sent, so notification isn't re-sent at every check and its re-sending stops at limit
+func (q *ackQueue) postpone(ref EmailRef, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if ack, ok := q.pending[ref]; ok {
+		ack.Sent += 1
+		ack.Next = now.Add(reminderInterval(ack.Notification, ack.Sent))
+	}
+}
+
+// remove stops tracking of notification. Returns nil if notification isn't waiting for acknowledgement.
+func (q *ackQueue) remove(ref EmailRef) *PendingAck {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ack, ok := q.pending[ref]
+	if !ok {
+		return nil
+	}
+	delete(q.pending, ref)
+	return ack
+}
+
+// takeDue returns notifications which should be re-sent at now and expired notifications. Urgent notifications
+// which were re-sent urgentResendLimit times expire and are not tracked anymore, emails which require
+// acknowledgement are reminded until user acknowledges or reads them.
+func (q *ackQueue) takeDue(now time.Time) ([]*PendingAck, []*PendingAck) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	due := make([]*PendingAck, 0)
+	expired := make([]*PendingAck, 0)
+	for ref, ack := range q.pending {
+		if ack.Next.After(now) {
+			continue
+		}
+		if !ack.Notification.RequiresAck && ack.Sent > urgentResendLimit {
+			delete(q.pending, ref)
+			expired = append(expired, ack)
+			continue
+		}
+		due = append(due, ack)
+	}
+	return due, expired
+}
+
+// folderUIDs returns UIDs of account's emails in folder which wait for acknowledgement
+func (q *ackQueue) folderUIDs(accountID int, folder string) []uint32 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	uids := make([]uint32, 0)
+	for ref := range q.pending {
+		if ref.AccountID == accountID && ref.Folder == folder {
+			uids = append(uids, ref.UID)
+		}
+	}
+	return uids
+}
+
+// snapshot returns copy of pending notifications for storage
+func (q *ackQueue) snapshot() []*PendingAck {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	acks := make([]*PendingAck, 0, len(q.pending))
+	for _, ack := range q.pending {
+		ackCopy := *ack
+		acks = append(acks, &ackCopy)
+	}
+	return acks
+}
+
+func (q *ackQueue) restore(acks []*PendingAck) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = make(map[EmailRef]*PendingAck, len(acks))
+	for _, ack := range acks {
+		if ack.Notification != nil {
+			q.pending[ack.Notification.ref()] = ack
+		}
+	}
+}
+
+// ResendUnacknowledged sends again notifications which user didn't acknowledge and unpins expired ones.
+// Reminders are sent silently during quiet hours, except urgent notifications.
+func (u *StoredUser) ResendUnacknowledged(now time.Time) {
+	due, expired := u.acks.takeDue(now)
+	if len(due) == 0 && len(expired) == 0 {
+		return
+	}
+	_, quiet := u.QuietHours.end(now)
+	for _, ack := range expired {
+		if ack.Notification.Priority == priorityUrgent {
+			u.unpinMessage(ack.MessageID)
+		}
+	}
+	for _, ack := range due {
+		notification := ack.Notification
+		boxHandler := u.findEmailBoxHandler(notification.AccountID)
+		if boxHandler == nil {
+			u.acks.remove(notification.ref())
+			continue
+		}
+		if notification.Priority == priorityUrgent {
+			u.unpinMessage(ack.MessageID)
+		}
+		notification.Reminder = ack.Sent
+		notification.Silent = quiet && notification.Priority != priorityUrgent
+		if !boxHandler.SendNotification(notification) {
+			u.acks.postpone(notification.ref(), now)
+		}
+	}
+	u.Save()
+}
+
+// Acknowledge stops re-sending of notification and unpins it
+func (u *StoredUser) Acknowledge(ref EmailRef) string {
+	ack := u.acks.remove(ref)
+	if ack == nil {
+		return "Notification is already acknowledged"
+	}
+	if ack.Notification.Priority == priorityUrgent {
+		u.unpinMessage(ack.MessageID)
+	}
+	u.Save()
+	return "Acknowledged"
+}
+
+// checkSeenAcks acknowledges notifications about emails in selected folder which were read on server,
+// moved or deleted
+func (handler *EmailBoxHandler) checkSeenAcks(src MailSource, folder string) error {
+	uids := handler.user.acks.folderUIDs(handler.eAccount.id, folder)
+	if len(uids) == 0 {
+		return nil
+	}
+	messages, err := src.Fetch(folder, uids, []imap.FetchItem{imap.FetchUid, imap.FetchFlags})
+	if err != nil {
+		return err
+	}
+	unread := make(map[uint32]bool, len(uids))
+	for _, msg := range messages {
+		seen := false
+		for _, flag := range msg.Flags {
+			if flag == imap.SeenFlag {
+				seen = true
+			}
+		}
+		unread[msg.Uid] = !seen
+	}
+	for _, uid := range uids {
+		if !unread[uid] {
+			handler.user.mu.Lock()
+			handler.user.Acknowledge(EmailRef{AccountID: handler.eAccount.id, Folder: folder, UID: uid})
+			handler.user.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+func (u *StoredUser) pinMessage(messageID int) {
+	pin := tgbotapi.PinChatMessageConfig{ChatID: u.ChatID, MessageID: messageID}
+	if _, err := u.messenger.PinChatMessage(pin); err != nil {
+		log.Println("Error pinning urgent notification. ", err)
+	}
+}
+
+func (u *StoredUser) unpinMessage(messageID int) {
+	if _, err := u.messenger.UnpinMessage(u.ChatID, messageID); err != nil {
+		log.Println("Error unpinning urgent notification. ", err)
+	}
+}